@@ -0,0 +1,221 @@
+package agenttest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Card describes the OpenPGP smart card a Server emulates.
+type Card struct {
+	Reader  string
+	Serial  string
+	AppType string
+	ExtCap  string
+
+	LoginData       string
+	DisplayName     string
+	DisplayLanguage string
+	DisplaySex      int
+	PubkeyURL       string
+
+	SignatureCounter int
+
+	// CHVStatus is the raw value of the CHV-STATUS line, such as
+	// "+1+127+127+127+3+0+3".
+	CHVStatus string
+
+	// Keys describes the signature, encryption and authentication key.
+	Keys [3]CardKey
+
+	// PIN and AdminPIN, if set, are asked for by SCD CHECKPIN through the
+	// loopback pinentry.
+	PIN      string
+	AdminPIN string
+}
+
+// CardKey describes a key slot of a Card. Slots without a keygrip are empty.
+type CardKey struct {
+	Keygrip     string
+	Fingerprint string
+	Created     time.Time
+}
+
+// SetCard inserts card into the emulated reader, or removes the current card
+// if card is nil.
+func (s *Server) SetCard(card *Card) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if card == nil {
+		s.card = nil
+		return
+	}
+
+	c := *card
+	s.card = &c
+}
+
+// Card returns a copy of the card currently inserted, or nil if there is none.
+func (s *Server) Card() *Card {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.card == nil {
+		return nil
+	}
+
+	c := *s.card
+	return &c
+}
+
+// updateCard calls f with the current card while holding the lock.
+func (s *Server) updateCard(f func(card *Card) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.card == nil {
+		return errNoCard
+	}
+
+	return f(s.card)
+}
+
+var errNoCard = newError(sourceSCD, errCardNotPresent, "Card not present")
+
+// learn sends the status lines describing card, the way LEARN does.
+func (sess *session) learn(card *Card) error {
+	var lines [][2]string
+	add := func(keyword, value string) {
+		if value != "" {
+			lines = append(lines, [2]string{keyword, value})
+		}
+	}
+
+	add("READER", card.Reader)
+	add("SERIALNO", card.Serial)
+	add("APPTYPE", card.AppType)
+	add("EXTCAP", card.ExtCap)
+	add("DISP-NAME", card.DisplayName)
+	add("DISP-LANG", card.DisplayLanguage)
+	add("DISP-SEX", strconv.Itoa(card.DisplaySex))
+	add("PUBKEY-URL", card.PubkeyURL)
+	add("LOGIN-DATA", card.LoginData)
+
+	for i, key := range card.Keys {
+		if key.Keygrip == "" {
+			continue
+		}
+
+		add("KEY-FPR", fmt.Sprintf("%d %s", i+1, key.Fingerprint))
+		if !key.Created.IsZero() {
+			add("KEY-TIME", fmt.Sprintf("%d %d", i+1, key.Created.Unix()))
+		}
+	}
+
+	add("CHV-STATUS", card.CHVStatus)
+	add("SIG-COUNTER", strconv.Itoa(card.SignatureCounter))
+
+	for i, key := range card.Keys {
+		if key.Keygrip != "" {
+			add("KEYPAIRINFO", fmt.Sprintf("%s OPENPGP.%d", key.Keygrip, i+1))
+		}
+	}
+
+	for _, line := range lines {
+		if err := sess.writeLine("S %s %s", line[0], escape([]byte(line[1]))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cmdLearn(sess *session, args string) error {
+	card := sess.server.Card()
+	if card == nil {
+		return errNoCard
+	}
+
+	return sess.learn(card)
+}
+
+func cmdScdSerialNo(sess *session, args string) error {
+	card := sess.server.Card()
+	if card == nil {
+		return errNoCard
+	}
+
+	return sess.status("SERIALNO", "%s", card.Serial)
+}
+
+func cmdScdSetAttr(sess *session, args string) error {
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) != 2 {
+		return newError(sourceSCD, errAssParameter, "IPC parameter error")
+	}
+	value := string(unescape(parts[1]))
+
+	return sess.server.updateCard(func(card *Card) error {
+		switch parts[0] {
+		case "DISP-NAME":
+			card.DisplayName = value
+		case "DISP-LANG":
+			card.DisplayLanguage = value
+		case "LOGIN-DATA":
+			card.LoginData = value
+		case "PUBKEY-URL":
+			card.PubkeyURL = value
+		case "DISP-SEX":
+			sex, err := strconv.Atoi(value)
+			if err != nil {
+				return newError(sourceSCD, errInvalidValue, "Invalid value")
+			}
+			card.DisplaySex = sex
+		default:
+			return newError(sourceSCD, errInvalidValue, "Invalid value")
+		}
+
+		return nil
+	})
+}
+
+// cmdScdCardOnly succeeds as long as a card is inserted.
+func cmdScdCheckPIN(sess *session, args string) error {
+	card := sess.server.Card()
+	if card == nil {
+		return errNoCard
+	}
+
+	pin, prompt := card.PIN, "||Please enter the PIN"
+	if strings.HasSuffix(args, "[CHV3]") {
+		pin, prompt = card.AdminPIN, "|A|Please enter the Admin PIN"
+	}
+
+	if pin == "" {
+		return nil
+	}
+
+	if sess.options["pinentry-mode"] != "loopback" {
+		return newError(sourceGPGAgent, errNoPinentry, "No pinentry")
+	}
+
+	// Like scdaemon, ask for the PIN with a NEEDPIN inquiry.
+	entered, err := sess.inquire("NEEDPIN", prompt)
+	if err != nil {
+		return err
+	}
+
+	if string(entered) != pin {
+		return newError(sourceSCD, errBadPIN, "Bad PIN")
+	}
+
+	return nil
+}
+
+func cmdScdCardOnly(sess *session, args string) error {
+	return sess.server.updateCard(func(card *Card) error {
+		return nil
+	})
+}
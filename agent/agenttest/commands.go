@@ -0,0 +1,514 @@
+package agenttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/abesto/sexp"
+	"github.com/cognitive-i/gpg/agent/internal/x25519"
+)
+
+// commandFunc runs a command. Returning an Error makes the command fail with
+// it, any other error closes the connection.
+type commandFunc func(sess *session, args string) error
+
+var commands map[string]commandFunc
+
+func init() {
+	commands = map[string]commandFunc{
+		"NOP":        cmdNop,
+		"RESET":      cmdReset,
+		"OPTION":     cmdOption,
+		"GETINFO":    cmdGetInfo,
+		"KEYINFO":    cmdKeyInfo,
+		"READKEY":    cmdReadKey,
+		"HAVEKEY":    cmdHaveKey,
+		"SETKEY":     cmdSetKey,
+		"SETKEYDESC": cmdSetKeyDesc,
+		"SETHASH":    cmdSetHash,
+		"PKSIGN":     cmdPKSign,
+		"PKDECRYPT":  cmdPKDecrypt,
+		"LEARN":      cmdLearn,
+
+		"UPDATESTARTUPTTY": cmdUpdateStartupTTY,
+
+		"GENKEY":      cmdGenKey,
+		"KEYWRAP_KEY": cmdKeyWrapKey,
+		"IMPORT_KEY":  cmdImportKey,
+		"EXPORT_KEY":  cmdExportKey,
+		"DELETE_KEY":  cmdDeleteKey,
+
+		"PASSWD":            cmdPasswd,
+		"PRESET_PASSPHRASE": cmdPresetPassphrase,
+		"CLEAR_PASSPHRASE":  cmdClearPassphrase,
+
+		"SCD LEARN":    cmdLearn,
+		"SCD SERIALNO": cmdScdSerialNo,
+		"SCD SETATTR":  cmdScdSetAttr,
+		"SCD PASSWD":   cmdScdCardOnly,
+		"SCD CHECKPIN": cmdScdCheckPIN,
+		"SCD RESET":    cmdScdCardOnly,
+		"SCD APDU":     cmdScdCardOnly,
+	}
+}
+
+// options lists the options supported by each command, as reported by
+// GETINFO cmd_has_option.
+var options = map[string][]string{
+	"KEYINFO": {"list", "ssh-fpr"},
+	"SETHASH": {"hash", "inquire"},
+	"LEARN":   {"sendinfo", "ssh-fpr"},
+}
+
+var (
+	errParameter   = newError(sourceGPGAgent, errAssParameter, "IPC parameter error")
+	errKeyNotFound = newError(sourceGPGAgent, errNotFound, "Not found")
+)
+
+func cmdNop(sess *session, args string) error {
+	return nil
+}
+
+func cmdReset(sess *session, args string) error {
+	sess.keygrip = ""
+	sess.hash = hashValue{}
+	sess.keydesc = ""
+	sess.importKEK = nil
+	sess.exportKEK = nil
+	return nil
+}
+
+func cmdOption(sess *session, args string) error {
+	parts := strings.SplitN(args, "=", 2)
+	if len(parts) == 1 {
+		parts = strings.SplitN(args, " ", 2)
+	}
+
+	name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "--")
+	if name == "" {
+		return errParameter
+	}
+
+	var value string
+	if len(parts) == 2 {
+		// Like gpg-agent, an option without a value is accepted, but not
+		// an empty one.
+		if value = strings.TrimSpace(parts[1]); value == "" {
+			return newError(sourceGPGAgent, errAssSyntax, "IPC syntax error")
+		}
+	}
+
+	sess.options[name] = value
+	sess.setenv(name, value)
+	return nil
+}
+
+func cmdGetInfo(sess *session, args string) error {
+	parts := strings.Fields(args)
+	if len(parts) == 0 {
+		return errParameter
+	}
+
+	switch parts[0] {
+	case "version":
+		return sess.data([]byte(sess.server.Version))
+	case "pid":
+		return sess.data([]byte(strconv.Itoa(os.Getpid())))
+	case "socket_name":
+		return sess.data([]byte(sess.server.Socket))
+	case "cmd_has_option":
+		if len(parts) != 3 {
+			return errParameter
+		}
+
+		for _, opt := range options[strings.ToUpper(parts[1])] {
+			if opt == parts[2] {
+				return nil
+			}
+		}
+
+		return newError(sourceGPGAgent, errFalse, "False")
+	}
+
+	return errParameter
+}
+
+// parseFlags splits args into leading --flags and the remaining arguments.
+func parseFlags(args string) (flags map[string]string, rest []string) {
+	flags = map[string]string{}
+	parts := strings.Fields(args)
+	for len(parts) > 0 && strings.HasPrefix(parts[0], "--") {
+		flag := strings.SplitN(parts[0][2:], "=", 2)
+		if len(flag) == 1 {
+			flag = append(flag, "")
+		}
+
+		parts = parts[1:]
+		if flag[0] == "" {
+			break
+		}
+		flags[flag[0]] = flag[1]
+	}
+
+	return flags, parts
+}
+
+func cmdKeyInfo(sess *session, args string) error {
+	flags, rest := parseFlags(args)
+
+	if _, ok := flags["list"]; ok {
+		for _, key := range sess.server.keyList() {
+			if err := sess.status("KEYINFO", "%s", key.keyInfo()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	key, ok := sess.server.key(rest[0])
+	if !ok {
+		return errKeyNotFound
+	}
+
+	return sess.status("KEYINFO", "%s", key.keyInfo())
+}
+
+func cmdReadKey(sess *session, args string) error {
+	_, rest := parseFlags(args)
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	key, ok := sess.server.key(rest[0])
+	if !ok {
+		return newError(sourceGPGAgent, errNoEntry, "No such file or directory")
+	}
+
+	pub, err := publicKey(key.PrivateKey)
+	if err != nil {
+		return newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+	}
+
+	data, err := encodePublicKey(pub)
+	if err != nil {
+		return newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+	}
+
+	return sess.data(data)
+}
+
+func cmdHaveKey(sess *session, args string) error {
+	_, rest := parseFlags(args)
+	for _, keygrip := range rest {
+		if _, ok := sess.server.key(keygrip); ok {
+			return nil
+		}
+	}
+
+	return newError(sourceGPGAgent, errNoSecretKey, "No secret key")
+}
+
+func cmdSetKey(sess *session, args string) error {
+	if b, err := hex.DecodeString(args); err != nil || len(b) != 20 {
+		return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+	}
+
+	sess.keygrip = strings.ToUpper(args)
+	return nil
+}
+
+// hashValue is the hash set by SETHASH.
+type hashValue struct {
+	algo  crypto.Hash
+	value []byte
+}
+
+var hashNames = map[string]crypto.Hash{
+	"md5":         crypto.MD5,
+	"sha1":        crypto.SHA1,
+	"rmd160":      crypto.RIPEMD160,
+	"sha224":      crypto.SHA224,
+	"sha256":      crypto.SHA256,
+	"sha384":      crypto.SHA384,
+	"sha512":      crypto.SHA512,
+	"tls-md5sha1": crypto.MD5SHA1,
+}
+
+// hashNumbers maps libgcrypt's hash algorithm numbers.
+var hashNumbers = map[string]crypto.Hash{
+	"1":  crypto.MD5,
+	"2":  crypto.SHA1,
+	"3":  crypto.RIPEMD160,
+	"8":  crypto.SHA256,
+	"9":  crypto.SHA384,
+	"10": crypto.SHA512,
+	"11": crypto.SHA224,
+}
+
+func cmdSetHash(sess *session, args string) error {
+	flags, rest := parseFlags(args)
+
+	var algo crypto.Hash
+	if name, ok := flags["hash"]; ok {
+		if algo, ok = hashNames[name]; !ok {
+			return newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+		}
+	} else if len(rest) > 0 {
+		var ok bool
+		if algo, ok = hashNumbers[rest[0]]; !ok {
+			return newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+		}
+		rest = rest[1:]
+	}
+
+	if _, ok := flags["inquire"]; ok {
+		if len(rest) != 0 {
+			return errParameter
+		}
+
+		data, err := sess.inquire("TBSDATA", "")
+		if err != nil {
+			return err
+		}
+
+		sess.hash = hashValue{algo: algo, value: data}
+		return nil
+	}
+
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	value, err := hex.DecodeString(rest[0])
+	if err != nil {
+		return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+	}
+
+	if algo != 0 && algo.Available() && algo.Size() != len(value) {
+		return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+	}
+
+	sess.hash = hashValue{algo: algo, value: value}
+	return nil
+}
+
+func cmdSetKeyDesc(sess *session, args string) error {
+	if args == "" {
+		return errParameter
+	}
+
+	sess.keydesc = string(unescape(strings.Replace(args, "+", " ", -1)))
+	return nil
+}
+
+// clearKeyDesc forgets the description set by SETKEYDESC, which only applies
+// to a single command.
+func (sess *session) clearKeyDesc() {
+	sess.keydesc = ""
+}
+
+// sessionKey returns the key set by SETKEY.
+func (sess *session) sessionKey() (Key, error) {
+	if sess.keygrip == "" {
+		return Key{}, newError(sourceGPGAgent, errNoSecretKey, "No secret key")
+	}
+
+	key, ok := sess.server.key(sess.keygrip)
+	if !ok {
+		return Key{}, newError(sourceGPGAgent, errNoSecretKey, "No secret key")
+	}
+
+	return key, nil
+}
+
+func cmdPKSign(sess *session, args string) error {
+	defer sess.clearKeyDesc()
+
+	key, err := sess.sessionKey()
+	if err != nil {
+		return err
+	}
+
+	if sess.hash.value == nil {
+		return newError(sourceGPGAgent, errNoData, "No data")
+	}
+
+	if err := sess.unlock(key); err != nil {
+		return err
+	}
+
+	var sig []interface{}
+	switch priv := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, priv, sess.hash.algo, sess.hash.value)
+		if err != nil {
+			return newError(sourceGPGAgent, errInvalidValue, err.Error())
+		}
+
+		sig = []interface{}{[]byte("rsa"), []interface{}{[]byte("s"), s}}
+
+	case *ecdsa.PrivateKey:
+		// Like gpg-agent, refuse digests shorter than the curve's order,
+		// capped at 512 bits.
+		size := priv.Curve.Params().BitSize / 8
+		if size > 64 {
+			size = 64
+		}
+
+		if len(sess.hash.value) < size {
+			return newError(sourceGPGAgent, errInvalidLength, "Invalid length")
+		}
+
+		r, s, err := ecdsa.Sign(rand.Reader, priv, sess.hash.value)
+		if err != nil {
+			return newError(sourceGPGAgent, errInvalidValue, err.Error())
+		}
+
+		sig = []interface{}{
+			[]byte("ecdsa"),
+			[]interface{}{[]byte("r"), mpi(r.Bytes())},
+			[]interface{}{[]byte("s"), mpi(s.Bytes())},
+		}
+
+	case ed25519.PrivateKey:
+		// Like gpg-agent, sign whatever was passed to SETHASH as the message.
+		s := ed25519.Sign(priv, sess.hash.value)
+		sig = []interface{}{
+			[]byte("eddsa"),
+			[]interface{}{[]byte("r"), s[:ed25519.SignatureSize/2]},
+			[]interface{}{[]byte("s"), s[ed25519.SignatureSize/2:]},
+		}
+
+	default:
+		return newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+	}
+
+	data, err := sexp.Marshal([]interface{}{[]byte("sig-val"), sig}, true)
+	if err != nil {
+		return err
+	}
+
+	return sess.data(data)
+}
+
+func cmdPKDecrypt(sess *session, args string) error {
+	defer sess.clearKeyDesc()
+
+	key, err := sess.sessionKey()
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := sess.inquire("CIPHERTEXT", "")
+	if err != nil {
+		return err
+	}
+
+	if err := sess.unlock(key); err != nil {
+		return err
+	}
+
+	algo, params, err := parseEncVal(ciphertext)
+	if err != nil {
+		return err
+	}
+
+	var plaintext []byte
+	switch priv := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		a, ok := params["a"]
+		if algo != "rsa" || !ok {
+			return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+		}
+
+		c := new(big.Int).SetBytes(a)
+		plaintext = new(big.Int).Exp(c, priv.D, priv.N).Bytes()
+
+	case *ecdsa.PrivateKey:
+		e, ok := params["e"]
+		if algo != "ecdh" || !ok {
+			return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+		}
+
+		x, y := elliptic.Unmarshal(priv.Curve, e)
+		if x == nil {
+			return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+		}
+
+		x, y = priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+		plaintext = elliptic.Marshal(priv.Curve, x, y)
+
+	case X25519PrivateKey:
+		e, ok := params["e"]
+		if algo != "ecdh" || !ok || len(e) != x25519.Size+1 || e[0] != 0x40 {
+			return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+		}
+
+		plaintext = append([]byte{0x40}, x25519.X25519(priv, e[1:])...)
+
+	default:
+		return newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+	}
+
+	data, err := sexp.Marshal([]interface{}{[]byte("value"), plaintext}, true)
+	if err != nil {
+		return err
+	}
+
+	return sess.data(data)
+}
+
+// parseEncVal parses a (enc-val(algo(name value)...)) expression.
+func parseEncVal(data []byte) (algo string, params map[string][]byte, err error) {
+	errExpr := newError(sourceGPGAgent, errSyntax, "Invalid S-expression")
+
+	exp, err := sexp.Unmarshal(data)
+	if err != nil || len(exp) != 2 {
+		return "", nil, errExpr
+	}
+
+	if name, ok := exp[0].([]byte); !ok || string(name) != "enc-val" {
+		return "", nil, errExpr
+	}
+
+	l, ok := exp[1].([]interface{})
+	if !ok || len(l) == 0 {
+		return "", nil, errExpr
+	}
+
+	name, ok := l[0].([]byte)
+	if !ok {
+		return "", nil, errExpr
+	}
+
+	params = map[string][]byte{}
+	for _, p := range l[1:] {
+		pl, ok := p.([]interface{})
+		if !ok || len(pl) != 2 {
+			return "", nil, errExpr
+		}
+
+		k, ok1 := pl[0].([]byte)
+		v, ok2 := pl[1].([]byte)
+		if !ok1 || !ok2 {
+			return "", nil, errExpr
+		}
+		params[string(k)] = v
+	}
+
+	return string(name), params, nil
+}
@@ -0,0 +1,27 @@
+package agenttest
+
+func cmdDeleteKey(sess *session, args string) error {
+	flags, rest := parseFlags(args)
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	key, ok := sess.server.key(rest[0])
+	if !ok {
+		return newError(sourceGPGAgent, errNoSecretKey, "No secret key")
+	}
+
+	stub := key.SerialNo != ""
+	if hasFlag(flags, "stub-only") && !stub {
+		return newError(sourceGPGAgent, errForbidden, "Forbidden")
+	}
+
+	// Like gpg-agent, ask for confirmation before deleting anything but a
+	// stub. There is no pinentry to do so here.
+	if !stub && !hasFlag(flags, "force") {
+		return newError(sourceGPGAgent, errNoPinentry, "No pinentry")
+	}
+
+	sess.server.RemoveKey(key.Keygrip)
+	return nil
+}
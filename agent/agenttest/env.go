@@ -0,0 +1,64 @@
+package agenttest
+
+import "strings"
+
+// envOptions maps the options setting the environment of pinentry to the
+// environment variables they set.
+var envOptions = map[string]string{
+	"display":            "DISPLAY",
+	"ttyname":            "GPG_TTY",
+	"ttytype":            "TERM",
+	"lc-ctype":           "LC_CTYPE",
+	"lc-messages":        "LC_MESSAGES",
+	"xauthority":         "XAUTHORITY",
+	"pinentry-user-data": "PINENTRY_USER_DATA",
+}
+
+// StartupEnv returns the environment set by the last UPDATESTARTUPTTY, which
+// gpg-agent uses for the pinentry of requests without one of their own.
+func (s *Server) StartupEnv() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	env := make(map[string]string, len(s.startupEnv))
+	for name, value := range s.startupEnv {
+		env[name] = value
+	}
+
+	return env
+}
+
+// setenv updates the environment of pinentry for the option name, if it's
+// one of those setting it.
+func (sess *session) setenv(name, value string) {
+	if name == "putenv" {
+		if i := strings.IndexByte(value, '='); i >= 0 {
+			sess.env[value[:i]] = value[i+1:]
+		} else {
+			delete(sess.env, value)
+		}
+
+		return
+	}
+
+	if env, ok := envOptions[name]; ok {
+		if value == "" {
+			delete(sess.env, env)
+		} else {
+			sess.env[env] = value
+		}
+	}
+}
+
+func cmdUpdateStartupTTY(sess *session, args string) error {
+	env := make(map[string]string, len(sess.env))
+	for name, value := range sess.env {
+		env[name] = value
+	}
+
+	sess.server.mu.Lock()
+	sess.server.startupEnv = env
+	sess.server.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package agenttest
+
+import "fmt"
+
+// Error is sent to the client as an ERR line.
+type Error struct {
+	Code        int
+	Description string
+}
+
+// Error implements the error interface.
+func (e Error) Error() string {
+	return e.Description
+}
+
+// These constants define the libgpg-error sources used by the server.
+const (
+	sourceGPGAgent = 4
+	sourceSCD      = 6
+)
+
+// These constants define the libgpg-error codes used by the server.
+const (
+	errBadPassphrase    = 11
+	errNoSecretKey      = 17
+	errNotFound         = 27
+	errSyntax           = 29
+	errInvalidValue     = 55
+	errNoData           = 58
+	errNotSupported     = 60
+	errNotImplemented   = 69
+	errUnsupportedAlgo  = 84
+	errNoPinentry       = 85
+	errBadPIN           = 87
+	errCanceled         = 99
+	errCardNotPresent   = 112
+	errInvalidLength    = 139
+	errNoPassphrase     = 177
+	errForbidden        = 251
+	errFalse            = 256
+	errAssUnknownCmd    = 275
+	errAssSyntax        = 276
+	errAssCanceled      = 277
+	errAssUnexpectedCmd = 278
+	errAssParameter     = 280
+	errExists           = 1<<15 | 35
+	errNoEntry          = 1<<15 | 81
+)
+
+var sourceNames = map[int]string{
+	sourceGPGAgent: "GPG Agent",
+	sourceSCD:      "SCD",
+}
+
+// NewError returns the Error gpg-agent would send for the specified
+// libgpg-error source and code.
+func NewError(source, code int, description string) Error {
+	return newError(source, code, description)
+}
+
+func newError(source, code int, description string) Error {
+	return Error{
+		Code:        source<<24 | code,
+		Description: fmt.Sprintf("%s <%s>", description, sourceNames[source]),
+	}
+}
@@ -0,0 +1,179 @@
+package agenttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+
+	"github.com/abesto/sexp"
+	"github.com/cognitive-i/gpg/agent/internal/keywrap"
+)
+
+func cmdExportKey(sess *session, args string) error {
+	defer sess.clearKeyDesc()
+
+	flags, rest := parseFlags(args)
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	if sess.exportKEK == nil {
+		return newError(sourceGPGAgent, errNoData, "No data")
+	}
+
+	key, ok := sess.server.key(rest[0])
+	if !ok {
+		return newError(sourceGPGAgent, errNoSecretKey, "No secret key")
+	}
+
+	if key.SerialNo != "" {
+		return newError(sourceGPGAgent, errNotSupported, "Not supported")
+	}
+
+	if err := sess.unlock(key); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	if hasFlag(flags, "openpgp") {
+		if !key.Protected {
+			return newError(sourceGPGAgent, errNoPassphrase, "No passphrase given")
+		}
+
+		data, err = encodeOpenPGPKey(key)
+	} else {
+		data, err = encodePrivateKey(key.PrivateKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Pad the key the way gpg-agent does, with zeros up to a multiple of the
+	// key wrap block size.
+	padded := make([]byte, (len(data)+7)/8*8)
+	copy(padded, data)
+
+	wrapped, err := keywrap.Wrap(sess.exportKEK, padded)
+	if err != nil {
+		return err
+	}
+
+	return sess.data(wrapped)
+}
+
+// unlock checks the passphrase of key, if it is protected by a known and
+// uncached one. Like gpg-agent in loopback mode, the passphrase is inquired
+// from the client, otherwise it's asked for by Server.Pinentry. It's cached
+// once it was entered correctly.
+func (sess *session) unlock(key Key) error {
+	if !key.Protected || key.Cached || key.Passphrase == nil {
+		return nil
+	}
+
+	var passphrase []byte
+	var err error
+	switch {
+	case sess.options["pinentry-mode"] == "loopback":
+		passphrase, err = sess.inquire("PASSPHRASE", "")
+	case sess.server.Pinentry != nil:
+		passphrase, err = sess.server.Pinentry(sess.keydesc, sess.options["pinentry-user-data"])
+		if _, ok := err.(Error); err != nil && !ok {
+			err = newError(sourceGPGAgent, errCanceled, "Operation cancelled")
+		}
+	default:
+		return newError(sourceGPGAgent, errNoPinentry, "No pinentry")
+	}
+	if err != nil {
+		return err
+	}
+
+	if string(passphrase) != string(key.Passphrase) {
+		return newError(sourceGPGAgent, errBadPassphrase, "Bad passphrase")
+	}
+
+	sess.server.updateKey(key.Keygrip, func(key *Key) {
+		key.Cached = true
+	})
+
+	return nil
+}
+
+// encodePrivateKey encodes priv the way EXPORT_KEY returns it.
+func encodePrivateKey(priv interface{}) ([]byte, error) {
+	param := func(name string, v []byte) []interface{} {
+		return []interface{}{[]byte(name), v}
+	}
+
+	var algo []interface{}
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(priv.Primes) != 2 {
+			return nil, newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+		}
+
+		// libgcrypt requires p < q, with u the inverse of p mod q.
+		p, q := priv.Primes[0], priv.Primes[1]
+		if p.Cmp(q) > 0 {
+			p, q = q, p
+		}
+		u := new(big.Int).ModInverse(p, q)
+
+		algo = []interface{}{
+			[]byte("rsa"),
+			param("n", mpi(priv.N.Bytes())),
+			param("e", mpi(big64(int64(priv.E)))),
+			param("d", mpi(priv.D.Bytes())),
+			param("p", mpi(p.Bytes())),
+			param("q", mpi(q.Bytes())),
+			param("u", mpi(u.Bytes())),
+		}
+
+	case ed25519.PrivateKey:
+		algo = []interface{}{
+			[]byte("ecc"),
+			param("curve", []byte("Ed25519")),
+			param("flags", []byte("eddsa")),
+			param("q", append([]byte{0x40}, priv.Public().(ed25519.PublicKey)...)),
+			param("d", priv.Seed()),
+		}
+
+	case *ecdsa.PrivateKey:
+		name := priv.Curve.Params().Name
+		if strings.HasPrefix(name, "P-") {
+			name = "NIST " + name
+		}
+
+		algo = []interface{}{
+			[]byte("ecc"),
+			param("curve", []byte(name)),
+			param("q", elliptic.Marshal(priv.Curve, priv.X, priv.Y)),
+			param("d", mpi(priv.D.Bytes())),
+		}
+
+	default:
+		return nil, newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+	}
+
+	return sexp.Marshal([]interface{}{[]byte("private-key"), algo}, true)
+}
+
+// encodeOpenPGPKey returns a stand-in for the openpgp-private-key expression
+// EXPORT_KEY --openpgp returns. Only its outer structure matches gpg-agent's:
+// the secret parameters are not actually encrypted.
+func encodeOpenPGPKey(key Key) ([]byte, error) {
+	data, err := encodePrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return sexp.Marshal([]interface{}{
+		[]byte("openpgp-private-key"),
+		[]interface{}{[]byte("version"), []byte("4")},
+		[]interface{}{[]byte("skey"), []byte("e"), data},
+		[]interface{}{[]byte("protection"), []byte("sha1"), []byte("aes")},
+	}, true)
+}
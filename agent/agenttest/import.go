@@ -0,0 +1,201 @@
+package agenttest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"math/big"
+
+	"github.com/abesto/sexp"
+	"github.com/cognitive-i/gpg"
+	"github.com/cognitive-i/gpg/agent/internal/keywrap"
+	"github.com/cognitive-i/gpg/internal/brainpool"
+)
+
+func cmdKeyWrapKey(sess *session, args string) error {
+	flags, _ := parseFlags(args)
+
+	_, clear := flags["clear"]
+	var kek *[]byte
+	switch {
+	case hasFlag(flags, "import"):
+		kek = &sess.importKEK
+	case hasFlag(flags, "export"):
+		kek = &sess.exportKEK
+	default:
+		return errParameter
+	}
+
+	if clear {
+		*kek = nil
+		return nil
+	}
+
+	if *kek == nil {
+		*kek = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, *kek); err != nil {
+			return err
+		}
+	}
+
+	return sess.data(*kek)
+}
+
+func hasFlag(flags map[string]string, name string) bool {
+	_, ok := flags[name]
+	return ok
+}
+
+func cmdImportKey(sess *session, args string) error {
+	flags, _ := parseFlags(args)
+
+	if sess.importKEK == nil {
+		return newError(sourceGPGAgent, errNoData, "No data")
+	}
+
+	wrapped, err := sess.inquire("KEYDATA", "")
+	if err != nil {
+		return err
+	}
+
+	keyData, err := keywrap.Unwrap(sess.importKEK, wrapped)
+	if err != nil {
+		return newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+	}
+
+	priv, err := parsePrivateKey(bytes.TrimRight(keyData, "\x00"))
+	if err != nil {
+		return err
+	}
+
+	key := Key{PrivateKey: priv}
+	pub, err := publicKey(priv)
+	if err != nil {
+		return err
+	}
+
+	keygrip, err := gpg.ComputeKeygrip(pub)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sess.server.key(keygrip); ok && !hasFlag(flags, "force") {
+		return newError(sourceGPGAgent, errExists, "File exists")
+	}
+
+	// Like gpg-agent, ask for the passphrase protecting the key. Only the
+	// loopback pinentry is available here.
+	if sess.options["pinentry-mode"] != "loopback" {
+		return newError(sourceGPGAgent, errNoPinentry, "No pinentry")
+	}
+
+	if key.Passphrase, err = sess.inquire("NEW_PASSPHRASE", ""); err != nil {
+		return err
+	}
+	key.Protected = len(key.Passphrase) > 0
+
+	_, err = sess.server.AddKey(key)
+	return err
+}
+
+// parsePrivateKey parses a (private-key(algo(name value)...)) expression.
+func parsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	errExpr := newError(sourceGPGAgent, errSyntax, "Invalid S-expression")
+
+	exp, err := sexp.Unmarshal(data)
+	if err != nil || len(exp) != 2 {
+		return nil, errExpr
+	}
+
+	if name, ok := exp[0].([]byte); !ok || string(name) != "private-key" {
+		return nil, errExpr
+	}
+
+	algo, params, err := parseParams(exp[1])
+	if err != nil {
+		return nil, errExpr
+	}
+
+	num := func(name string) *big.Int {
+		return new(big.Int).SetBytes(params[name])
+	}
+
+	switch algo {
+	case "rsa":
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: num("n"), E: int(num("e").Int64())},
+			D:         num("d"),
+			Primes:    []*big.Int{num("p"), num("q")},
+		}
+		if err := priv.Validate(); err != nil {
+			return nil, newError(sourceGPGAgent, errInvalidValue, err.Error())
+		}
+		priv.Precompute()
+
+		return priv, nil
+
+	case "ecc":
+		curve := string(params["curve"])
+		if curve == "Ed25519" {
+			if len(params["d"]) != ed25519.SeedSize {
+				return nil, newError(sourceGPGAgent, errInvalidValue, "Invalid value")
+			}
+
+			return ed25519.NewKeyFromSeed(params["d"]), nil
+		}
+
+		c, ok := curves[curve]
+		if !ok {
+			return nil, newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+		}
+
+		priv := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: c}, D: num("d")}
+		priv.X, priv.Y = c.ScalarBaseMult(priv.D.Bytes())
+		return priv, nil
+	}
+
+	return nil, newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+}
+
+// curves maps the names libgcrypt uses for the supported ECDSA curves.
+var curves = map[string]elliptic.Curve{
+	"NIST P-256":      elliptic.P256(),
+	"NIST P-384":      elliptic.P384(),
+	"NIST P-521":      elliptic.P521(),
+	"brainpoolP256r1": brainpool.P256r1(),
+	"brainpoolP384r1": brainpool.P384r1(),
+	"brainpoolP512r1": brainpool.P512r1(),
+}
+
+// parseParams parses an (algo(name value)...) list.
+func parseParams(exp interface{}) (string, map[string][]byte, error) {
+	errExpr := newError(sourceGPGAgent, errSyntax, "Invalid S-expression")
+
+	l, ok := exp.([]interface{})
+	if !ok || len(l) == 0 {
+		return "", nil, errExpr
+	}
+
+	algo, ok := l[0].([]byte)
+	if !ok {
+		return "", nil, errExpr
+	}
+
+	params := map[string][]byte{}
+	for _, p := range l[1:] {
+		if pl, ok := p.([]interface{}); ok && len(pl) >= 2 {
+			k, ok1 := pl[0].([]byte)
+			v, ok2 := pl[1].([]byte)
+			if ok1 && ok2 {
+				params[string(k)] = v
+			}
+		}
+	}
+
+	return string(algo), params, nil
+}
@@ -0,0 +1,111 @@
+package agenttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"strconv"
+
+	"github.com/abesto/sexp"
+)
+
+func cmdGenKey(sess *session, args string) error {
+	flags, _ := parseFlags(args)
+
+	param, err := sess.inquire("KEYPARAM", "")
+	if err != nil {
+		return err
+	}
+
+	priv, err := generateKey(param)
+	if err != nil {
+		return err
+	}
+
+	key := Key{PrivateKey: priv}
+	if _, ok := flags["no-protection"]; !ok {
+		key.Protected = true
+
+		if _, ok := flags["inq-passwd"]; ok {
+			if key.Passphrase, err = sess.inquire("NEWPASSWD", ""); err != nil {
+				return err
+			}
+		}
+
+		_, key.Cached = flags["preset"]
+	}
+
+	if _, err := sess.server.AddKey(key); err != nil {
+		return err
+	}
+
+	pub, err := publicKey(priv)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodePublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	return sess.data(data)
+}
+
+// generateKey creates a key as described by a (genkey(algo(name value)...))
+// expression.
+func generateKey(param []byte) (crypto.PrivateKey, error) {
+	errExpr := newError(sourceGPGAgent, errSyntax, "Invalid S-expression")
+	errAlgo := newError(sourceGPGAgent, errUnsupportedAlgo, "Unsupported algorithm")
+
+	exp, err := sexp.Unmarshal(param)
+	if err != nil || len(exp) != 2 {
+		return nil, errExpr
+	}
+
+	if name, ok := exp[0].([]byte); !ok || string(name) != "genkey" {
+		return nil, errExpr
+	}
+
+	algo, params, err := parseParams(exp[1])
+	if err != nil {
+		return nil, err
+	}
+
+	switch algo {
+	case "rsa":
+		bits, err := strconv.Atoi(string(params["nbits"]))
+		if err != nil {
+			return nil, errExpr
+		}
+
+		return rsa.GenerateKey(rand.Reader, bits)
+
+	case "ecc":
+		switch string(params["curve"]) {
+		case "Ed25519", "ed25519":
+			_, priv, err := ed25519.GenerateKey(rand.Reader)
+			return priv, err
+
+		case "Curve25519", "cv25519":
+			priv := make(X25519PrivateKey, 32)
+			_, err := io.ReadFull(rand.Reader, priv)
+			return priv, err
+
+		case "NIST P-256", "nistp256":
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		case "NIST P-384", "nistp384":
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+		case "NIST P-521", "nistp521":
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+	}
+
+	return nil, errAlgo
+}
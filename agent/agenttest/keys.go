@@ -0,0 +1,226 @@
+package agenttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"github.com/abesto/sexp"
+	"github.com/cognitive-i/gpg"
+	"github.com/cognitive-i/gpg/agent/internal/x25519"
+)
+
+// Key describes a key held by a Server.
+type Key struct {
+	// Keygrip identifies the key. If it's empty, AddKey computes it from
+	// the public key.
+	Keygrip string
+
+	// PrivateKey is the key itself, either an *rsa.PrivateKey, an
+	// *ecdsa.PrivateKey, an ed25519.PrivateKey or an X25519PrivateKey.
+	PrivateKey crypto.PrivateKey
+
+	// SerialNo and CardID are set for keys stored on a smart card.
+	SerialNo string
+	CardID   string
+
+	// Protected makes KEYINFO report the key as protected by a passphrase,
+	// Cached as having that passphrase cached.
+	Protected bool
+	Cached    bool
+
+	// Passphrase is the passphrase protecting the key, if it is known.
+	Passphrase []byte
+}
+
+// X25519PrivateKey is a Curve25519 scalar used for ECDH, encoded as in
+// RFC 7748.
+type X25519PrivateKey []byte
+
+// AddKey adds key to the server, replacing any key with the same keygrip,
+// and returns its keygrip.
+func (s *Server) AddKey(key Key) (string, error) {
+	pub, err := publicKey(key.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	if key.Keygrip == "" {
+		if key.Keygrip, err = gpg.ComputeKeygrip(pub); err != nil {
+			return "", err
+		}
+	}
+	key.Keygrip = strings.ToUpper(key.Keygrip)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.Keygrip] = &key
+	return key.Keygrip, nil
+}
+
+// RemoveKey removes the key with the specified keygrip from the server.
+func (s *Server) RemoveKey(keygrip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, strings.ToUpper(keygrip))
+}
+
+// key returns a copy of the key with the specified keygrip.
+func (s *Server) key(keygrip string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[strings.ToUpper(keygrip)]
+	if !ok {
+		return Key{}, false
+	}
+
+	return *key, true
+}
+
+// updateKey calls f with the key with the specified keygrip while holding
+// the lock. It reports whether the key exists.
+func (s *Server) updateKey(keygrip string, f func(key *Key)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[strings.ToUpper(keygrip)]
+	if ok {
+		f(key)
+	}
+
+	return ok
+}
+
+// keyList returns copies of all keys.
+func (s *Server) keyList() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+
+	return keys
+}
+
+// keyInfo formats the parameters of the KEYINFO status line for key.
+func (key Key) keyInfo() string {
+	keyType, protection := "D", "C"
+	if key.Protected {
+		protection = "P"
+	}
+	if key.SerialNo != "" {
+		keyType, protection = "T", "-"
+	}
+
+	cached := "-"
+	if key.Cached {
+		cached = "1"
+	}
+
+	return fmt.Sprintf("%s %s %s %s %s %s - - -", key.Keygrip, keyType, dash(key.SerialNo), dash(key.CardID), cached, protection)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func publicKey(priv crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		return &priv.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		return &priv.PublicKey, nil
+	case ed25519.PrivateKey:
+		return priv.Public(), nil
+	case X25519PrivateKey:
+		return gpg.X25519PublicKey(x25519.X25519(priv, x25519.Basepoint)), nil
+	}
+
+	return nil, fmt.Errorf("%T: unsupported private key", priv)
+}
+
+// encodePublicKey encodes pub the way READKEY returns it.
+func encodePublicKey(pub crypto.PublicKey) ([]byte, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return sexp.Marshal([]interface{}{
+			[]byte("public-key"),
+			[]interface{}{
+				[]byte("rsa"),
+				[]interface{}{[]byte("n"), mpi(pub.N.Bytes())},
+				[]interface{}{[]byte("e"), mpi(big64(int64(pub.E)))},
+			},
+		}, true)
+
+	case *ecdsa.PublicKey:
+		name := pub.Curve.Params().Name
+		if strings.HasPrefix(name, "P-") {
+			name = "NIST " + name
+		}
+
+		return sexp.Marshal([]interface{}{
+			[]byte("public-key"),
+			[]interface{}{
+				[]byte("ecc"),
+				[]interface{}{[]byte("curve"), []byte(name)},
+				[]interface{}{[]byte("q"), elliptic.Marshal(pub.Curve, pub.X, pub.Y)},
+			},
+		}, true)
+
+	case gpg.X25519PublicKey:
+		return sexp.Marshal([]interface{}{
+			[]byte("public-key"),
+			[]interface{}{
+				[]byte("ecc"),
+				[]interface{}{[]byte("curve"), []byte("Curve25519")},
+				[]interface{}{[]byte("flags"), []byte("djb-tweak")},
+				[]interface{}{[]byte("q"), append([]byte{0x40}, pub...)},
+			},
+		}, true)
+
+	case ed25519.PublicKey:
+		return sexp.Marshal([]interface{}{
+			[]byte("public-key"),
+			[]interface{}{
+				[]byte("ecc"),
+				[]interface{}{[]byte("curve"), []byte("Ed25519")},
+				[]interface{}{[]byte("flags"), []byte("eddsa")},
+				[]interface{}{[]byte("q"), append([]byte{0x40}, pub...)},
+			},
+		}, true)
+	}
+
+	return nil, fmt.Errorf("%T: unsupported public key", pub)
+}
+
+// mpi prefixes b with a zero byte if its high bit is set, the way libgcrypt
+// prints unsigned integers.
+func mpi(b []byte) []byte {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return append([]byte{0}, b...)
+	}
+
+	return b
+}
+
+func big64(v int64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+
+	return b
+}
@@ -0,0 +1,97 @@
+package agenttest
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+func cmdPasswd(sess *session, args string) error {
+	flags, rest := parseFlags(args)
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	key, ok := sess.server.key(rest[0])
+	if !ok {
+		return newError(sourceGPGAgent, errNoSecretKey, "No secret key")
+	}
+
+	if key.SerialNo != "" {
+		return newError(sourceGPGAgent, errNotSupported, "Not supported")
+	}
+
+	if err := sess.unlock(key); err != nil || hasFlag(flags, "verify") {
+		return err
+	}
+
+	// Only the loopback pinentry is available to ask for the new passphrase.
+	if sess.options["pinentry-mode"] != "loopback" {
+		return newError(sourceGPGAgent, errNoPinentry, "No pinentry")
+	}
+
+	passphrase, err := sess.inquire("NEW_PASSPHRASE", "")
+	if err != nil {
+		return err
+	}
+
+	sess.server.updateKey(key.Keygrip, func(key *Key) {
+		key.Passphrase = passphrase
+		key.Protected = len(passphrase) > 0
+		key.Cached = key.Protected && hasFlag(flags, "preset")
+	})
+
+	return nil
+}
+
+func cmdPresetPassphrase(sess *session, args string) error {
+	flags, rest := parseFlags(args)
+	if !sess.server.AllowPresetPassphrase {
+		return newError(sourceGPGAgent, errNotSupported, "Not supported")
+	}
+
+	inquire := hasFlag(flags, "inquire")
+	if len(rest) != 2 && (inquire || len(rest) != 3) {
+		return errParameter
+	}
+
+	// Like gpg-agent, only support passphrases that never expire.
+	if rest[1] != "-1" {
+		return newError(sourceGPGAgent, errNotImplemented, "Not implemented")
+	}
+
+	var passphrase []byte
+	var err error
+	if inquire {
+		passphrase, err = sess.inquire("PASSPHRASE", "")
+	} else if len(rest) == 3 {
+		passphrase, err = hex.DecodeString(rest[2])
+	} else {
+		return newError(sourceGPGAgent, errNoPinentry, "No pinentry")
+	}
+	if err != nil {
+		return err
+	}
+
+	// gpg-agent caches whatever it is given, so a wrong passphrase only
+	// fails once it's used. Don't pretend to have cached one here.
+	sess.server.updateKey(rest[0], func(key *Key) {
+		if key.Passphrase == nil || bytes.Equal(key.Passphrase, passphrase) {
+			key.Cached = true
+		}
+	})
+
+	return nil
+}
+
+func cmdClearPassphrase(sess *session, args string) error {
+	_, rest := parseFlags(args)
+	if len(rest) != 1 {
+		return errParameter
+	}
+
+	sess.server.updateKey(rest[0], func(key *Key) {
+		key.Cached = false
+	})
+
+	return nil
+}
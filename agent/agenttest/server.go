@@ -0,0 +1,426 @@
+// Package agenttest provides a fake gpg-agent speaking the Assuan protocol,
+// for testing code built on the agent package without GnuPG installed.
+//
+// The server holds its keys in memory and emulates a smart card from a
+// scripted Card. Faults can be injected into any command.
+package agenttest
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultVersion is the gpg-agent version a Server reports unless told
+// otherwise.
+const DefaultVersion = "2.4.3"
+
+// maxLineLength is the maximum length of an Assuan line, without the
+// terminating newline.
+const maxLineLength = 1000
+
+// Fault describes how a Server misbehaves when it receives a command.
+type Fault struct {
+	// Delay postpones handling the command.
+	Delay time.Duration
+
+	// Err, if its Code is not zero, is sent instead of running the command.
+	Err Error
+
+	// Hangup closes the connection instead of running the command.
+	Hangup bool
+}
+
+// Server is a fake gpg-agent listening on a unix socket.
+type Server struct {
+	// Socket is the filename of the unix socket the server listens on.
+	Socket string
+
+	// Version is reported by GETINFO version. It must not be changed while
+	// clients are connected.
+	Version string
+
+	// AllowPresetPassphrase enables PRESET_PASSPHRASE, like the gpg-agent
+	// option of the same name. It must not be changed while clients are
+	// connected.
+	AllowPresetPassphrase bool
+
+	// Pinentry, if set, is called to ask for passphrases unless the
+	// pinentry-mode is loopback, with the description set by SETKEYDESC and
+	// the pinentry-user-data option. Errors that aren't an Error cancel the
+	// command. It must not be changed while clients are connected.
+	Pinentry func(desc, userData string) ([]byte, error)
+
+	dir      string
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	keys   map[string]*Key
+	card   *Card
+	faults map[string]Fault
+	conns  map[net.Conn]struct{}
+
+	// startupEnv is the environment set by UPDATESTARTUPTTY.
+	startupEnv map[string]string
+}
+
+// NewServer starts a Server without any keys or card. It must be shut down
+// with Close.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "agenttest")
+	if err != nil {
+		return nil, err
+	}
+
+	socket := filepath.Join(dir, "S.gpg-agent")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &Server{
+		Socket:   socket,
+		Version:  DefaultVersion,
+		dir:      dir,
+		listener: listener,
+		done:     make(chan struct{}),
+		keys:     map[string]*Key{},
+		faults:   map[string]Fault{},
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Close stops the server, disconnects all clients and removes the socket.
+func (s *Server) Close() error {
+	close(s.done)
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	if rmErr := os.RemoveAll(s.dir); err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+// Inject makes the server misbehave as described by f whenever it receives
+// command, until ClearFaults is called. The command is matched by its name,
+// such as "PKSIGN", or for scdaemon commands by "SCD" and the sub command,
+// such as "SCD LEARN".
+func (s *Server) Inject(command string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults[strings.ToUpper(command)] = f
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = map[string]Fault{}
+}
+
+// Disconnect closes the connections of all clients, as if gpg-agent had been
+// restarted. The server keeps accepting new connections.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func (s *Server) fault(command string) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.faults[command]
+	return f, ok
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			sess := &session{
+				server:  s,
+				c:       c,
+				r:       bufio.NewReader(c),
+				w:       bufio.NewWriter(c),
+				options: map[string]string{},
+				env:     map[string]string{},
+			}
+			sess.run()
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			_ = c.Close()
+		}()
+	}
+}
+
+// session holds the state of a single client connection.
+type session struct {
+	server *Server
+	c      net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+
+	options map[string]string
+	keygrip string
+	hash    hashValue
+
+	// env is the environment of pinentry, as set by options.
+	env map[string]string
+
+	// keydesc is the description set by SETKEYDESC for the next command
+	// asking for a passphrase.
+	keydesc string
+
+	// importKEK and exportKEK are the key wrapping keys returned by
+	// KEYWRAP_KEY.
+	importKEK []byte
+	exportKEK []byte
+}
+
+func (sess *session) run() {
+	if err := sess.writeLine("OK Pleased to meet you, process %d", os.Getpid()); err != nil {
+		return
+	}
+
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return
+		}
+
+		name, args := splitCommand(line)
+		if name == "" {
+			continue
+		}
+
+		if name == "SCD" {
+			var sub string
+			sub, args = splitCommand(args)
+			name += " " + sub
+		}
+
+		if f, ok := sess.server.fault(name); ok {
+			if f.Delay > 0 {
+				select {
+				case <-time.After(f.Delay):
+				case <-sess.server.done:
+					return
+				}
+			}
+
+			if f.Hangup {
+				return
+			}
+
+			if f.Err.Code != 0 {
+				if err := sess.writeError(f.Err); err != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		if name == "BYE" {
+			_ = sess.writeLine("OK closing connection")
+			return
+		}
+
+		handler, ok := commands[name]
+		if !ok {
+			err = newError(sourceGPGAgent, errAssUnknownCmd, "Unknown IPC command")
+		} else {
+			err = handler(sess, args)
+		}
+
+		if err == nil {
+			err = sess.writeLine("OK")
+		} else if e, ok := err.(Error); ok {
+			err = sess.writeError(e)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func splitCommand(line string) (name, args string) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	name = strings.ToUpper(parts[0])
+	if len(parts) == 2 {
+		args = strings.TrimSpace(parts[1])
+	}
+
+	return name, args
+}
+
+func (sess *session) readLine() (string, error) {
+	line, err := sess.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (sess *session) writeLine(format string, a ...interface{}) error {
+	if _, err := fmt.Fprintf(sess.w, format+"\n", a...); err != nil {
+		return err
+	}
+
+	return sess.w.Flush()
+}
+
+func (sess *session) writeError(e Error) error {
+	return sess.writeLine("ERR %d %s", e.Code, e.Description)
+}
+
+// status sends a status line.
+func (sess *session) status(keyword, format string, a ...interface{}) error {
+	return sess.writeLine("S %s %s", keyword, escape([]byte(fmt.Sprintf(format, a...))))
+}
+
+// data sends data in as many D lines as needed.
+func (sess *session) data(data []byte) error {
+	escaped := escape(data)
+	for len(escaped) > 0 {
+		n := maxLineLength - 2
+		if n > len(escaped) {
+			n = len(escaped)
+		}
+
+		// Don't split escape sequences.
+		if i := strings.LastIndexByte(escaped[:n], '%'); i >= 0 && i > n-3 && n < len(escaped) {
+			n = i
+		}
+
+		if err := sess.writeLine("D %s", escaped[:n]); err != nil {
+			return err
+		}
+		escaped = escaped[n:]
+	}
+
+	return nil
+}
+
+// inquire asks the client for data and returns its answer.
+func (sess *session) inquire(keyword, params string) ([]byte, error) {
+	if params != "" {
+		keyword += " " + params
+	}
+
+	if err := sess.writeLine("INQUIRE %s", keyword); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case line == "END":
+			return data, nil
+		case line == "CAN":
+			return nil, newError(sourceGPGAgent, errAssCanceled, "IPC call has been cancelled")
+		case line == "D":
+		case strings.HasPrefix(line, "D "):
+			data = append(data, unescape(line[2:])...)
+		default:
+			return nil, newError(sourceGPGAgent, errAssUnexpectedCmd, "Unexpected IPC command")
+		}
+	}
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// escape percent-escapes the characters that must not appear verbatim in
+// Assuan lines.
+func escape(data []byte) string {
+	var sb strings.Builder
+	for _, b := range data {
+		switch b {
+		case '%', '\r', '\n':
+			sb.WriteByte('%')
+			sb.WriteByte(hexDigits[b>>4])
+			sb.WriteByte(hexDigits[b&0xf])
+		default:
+			sb.WriteByte(b)
+		}
+	}
+
+	return sb.String()
+}
+
+func unescape(source string) []byte {
+	decoded := make([]byte, 0, len(source))
+	for i := 0; i < len(source); i++ {
+		if source[i] == '%' && i+2 < len(source) {
+			hi := strings.IndexByte(hexDigits, upper(source[i+1]))
+			lo := strings.IndexByte(hexDigits, upper(source[i+2]))
+			if hi >= 0 && lo >= 0 {
+				decoded = append(decoded, byte(hi<<4|lo))
+				i += 2
+				continue
+			}
+		}
+
+		decoded = append(decoded, source[i])
+	}
+
+	return decoded
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'f' {
+		return c - 'a' + 'A'
+	}
+
+	return c
+}
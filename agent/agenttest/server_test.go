@@ -0,0 +1,211 @@
+package agenttest_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cognitive-i/gpg/agent"
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+func startServer(t *testing.T) (*agenttest.Server, *agent.Conn) {
+	t.Helper()
+
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+
+	conn, err := agent.Dial(s.Socket, []string{"allow-pinentry-notify"})
+	if err != nil {
+		_ = s.Close()
+		t.Fatalf("Dial(): %s", err)
+	}
+
+	return s, conn
+}
+
+func stopServer(s *agenttest.Server, conn *agent.Conn) {
+	_ = conn.Close()
+	_ = s.Close()
+}
+
+func addRSAKey(t *testing.T, s *agenttest.Server, key agenttest.Key) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	key.PrivateKey = priv
+	keygrip, err := s.AddKey(key)
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	return priv, keygrip
+}
+
+func TestServerVersion(t *testing.T) {
+	s, conn := startServer(t)
+	defer stopServer(s, conn)
+
+	version, err := conn.Version()
+	if err != nil {
+		t.Fatalf("Version(): %s", err)
+	}
+
+	if version != agenttest.DefaultVersion {
+		t.Errorf("expected version %q, but got %q", agenttest.DefaultVersion, version)
+	}
+}
+
+func TestServerKeys(t *testing.T) {
+	s, conn := startServer(t)
+	defer stopServer(s, conn)
+	priv, keygrip := addRSAKey(t, s, agenttest.Key{Protected: true})
+
+	keys, err := conn.Keys()
+	if err != nil {
+		t.Fatalf("Keys(): %s", err)
+	}
+
+	if len(keys) != 1 || keys[0].Keygrip != keygrip || keys[0].Protection != agent.ProtByPassphrase {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+
+	key, err := conn.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	hashed := sha256.Sum256([]byte("Hello World"))
+	sig, err := key.Sign(nil, hashed[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if err := rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Fatalf("VerifyPKCS1v15(): %s", err)
+	}
+
+	message := []byte("Hello World OAEP")
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, message, nil)
+	if err != nil {
+		t.Fatalf("EncryptOAEP(): %s", err)
+	}
+
+	plaintext, err := key.Decrypt(nil, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatalf("Decrypt(): %s", err)
+	}
+
+	if string(plaintext) != string(message) {
+		t.Fatalf("plaintext message is %q, but expected %q", plaintext, message)
+	}
+
+	_, err = conn.Key("0000000000000000000000000000000000000000")
+	if !errors.Is(err, agent.ErrNotFound) {
+		t.Errorf("expected %v, but got %v", agent.ErrNotFound, err)
+	}
+}
+
+func TestServerCard(t *testing.T) {
+	s, conn := startServer(t)
+	defer stopServer(s, conn)
+
+	if _, err := conn.CurrentCard(); !agent.IsCardMissing(err) {
+		t.Fatalf("expected the card to be missing, but got %v", err)
+	}
+
+	_, keygrip := addRSAKey(t, s, agenttest.Key{SerialNo: "D2760001240103040006123456780000", CardID: "OPENPGP.1"})
+	s.SetCard(&agenttest.Card{
+		Reader:           "Fake Reader 00 00",
+		Serial:           "D2760001240103040006123456780000",
+		AppType:          "OPENPGP",
+		DisplayName:      "Doe<<John",
+		SignatureCounter: 3,
+		CHVStatus:        "+1+127+127+127+3+0+3",
+		Keys: [3]agenttest.CardKey{
+			{Keygrip: keygrip, Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567", Created: time.Unix(1600000000, 0)},
+		},
+	})
+
+	card, err := conn.CurrentCard()
+	if err != nil {
+		t.Fatalf("CurrentCard(): %s", err)
+	}
+
+	if card.Reader != "Fake Reader 00 00" || card.SignatureCounter != 3 || card.PINRetryCounter != [3]int{3, 0, 3} {
+		t.Errorf("unexpected card %+v", card)
+	}
+
+	sigKey := card.SignatureKey()
+	if sigKey == nil || sigKey.Keygrip != keygrip || sigKey.Type != agent.StoredOnCard || sigKey.Created.Unix() != 1600000000 {
+		t.Fatalf("unexpected signature key %+v", sigKey)
+	}
+
+	if err := card.SetDisplayLanguage("de"); err != nil {
+		t.Fatalf("SetDisplayLanguage(): %s", err)
+	}
+
+	if lang := s.Card().DisplayLanguage; lang != "de" {
+		t.Errorf("expected display language %q, but got %q", "de", lang)
+	}
+
+	grips, err := conn.KeyGrips()
+	if err != nil {
+		t.Fatalf("KeyGrips(): %s", err)
+	}
+
+	if grips["OPENPGP.1"] != keygrip {
+		t.Errorf("expected keygrip %q for OPENPGP.1, but got %v", keygrip, grips)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s, conn := startServer(t)
+	defer stopServer(s, conn)
+	_, keygrip := addRSAKey(t, s, agenttest.Key{})
+
+	key, err := conn.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+	hashed := sha256.Sum256([]byte("Hello World"))
+
+	s.Inject("PKSIGN", agenttest.Fault{Err: agenttest.NewError(5, 99, "Operation cancelled")})
+	if _, err := key.Sign(nil, hashed[:], crypto.SHA256); !agent.IsCanceled(err) {
+		t.Errorf("expected the operation to be cancelled, but got %v", err)
+	}
+
+	s.Inject("PKSIGN", agenttest.Fault{Delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := key.SignContext(ctx, nil, hashed[:], crypto.SHA256); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+
+	s.ClearFaults()
+	s.Inject("KEYINFO", agenttest.Fault{Hangup: true})
+
+	// The cancelled PKSIGN closed the connection, so start over.
+	conn, err = agent.Dial(s.Socket, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Keys(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v after the server hung up, but got %v", io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultAgentProgram is the program launched by WithAutostart, unless
+	// WithAgentProgram specifies another one.
+	defaultAgentProgram = "gpg-agent"
+
+	// autostartTimeout is how long we wait for a freshly launched gpg-agent
+	// to listen on its socket, like GnuPG itself does.
+	autostartTimeout = 5 * time.Second
+)
+
+// agentMissing reports whether dialing failed with err because no gpg-agent
+// is running. Like GnuPG, only then is it worth starting one; other errors,
+// such as a lack of permissions, would just make us wait for nothing.
+func agentMissing(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
+
+// startAgent launches gpg-agent as a daemon for the configured homedir and
+// waits for it to accept connections. If filename is "", the socket is
+// resolved again while waiting, as the agent may only create its socket
+// directory upon startup.
+func startAgent(ctx context.Context, cfg *dialConfig, filename string) (net.Conn, error) {
+	homedir, err := canonicalHomedir(cfg.homedir)
+	if err != nil {
+		return nil, err
+	}
+
+	program := cfg.agentProgram
+	if program == "" {
+		program = defaultAgentProgram
+	}
+
+	// The daemon forks, so the command returns as soon as it is up. It
+	// fails when another agent won the race to start, which is fine as long
+	// as the socket becomes available.
+	startErr := exec.CommandContext(ctx, program, "--homedir", homedir, "--daemon").Run()
+	if _, exited := startErr.(*exec.ExitError); startErr != nil && !exited {
+		return nil, startErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, autostartTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	delay := 10 * time.Millisecond
+	for {
+		socket := filename
+		if socket == "" {
+			if socket, err = SocketPath(homedir, cfg.socket); err != nil {
+				return nil, err
+			}
+		}
+
+		c, err := d.DialContext(ctx, "unix", socket)
+		if err == nil {
+			return c, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if startErr != nil {
+				return nil, startErr
+			}
+
+			return nil, err
+
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDialAutostart(t *testing.T) {
+	if _, err := exec.LookPath("gpg-agent"); err != nil {
+		t.Skip("gpg-agent is not installed")
+	}
+
+	homedir, err := ioutil.TempDir("", "gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(homedir)
+
+	if _, err := Dial("", nil, WithHomedir(homedir)); err == nil {
+		t.Fatal("expected an error dialing an agent that isn't running")
+	}
+
+	if _, err := Dial("", nil, WithHomedir(homedir), WithAutostart(), WithAgentProgram("/nonexistent/gpg-agent")); err == nil {
+		t.Fatal("expected an error starting a nonexistent agent")
+	}
+
+	started, err := Dial("", nil, WithHomedir(homedir), WithAutostart())
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer started.Close()
+	defer started.Raw(nil, "KILLAGENT")
+
+	if _, err := started.Version(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestDialAutostartOnlyWhenMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The socket can't exist below a regular file, so there's no point in
+	// starting an agent, which would fail with ENOENT here.
+	_, err = Dial(filepath.Join(file, "S.gpg-agent"), nil, WithAutostart(), WithAgentProgram("/nonexistent/gpg-agent"))
+	if !errors.Is(err, syscall.ENOTDIR) {
+		t.Fatalf("expected ENOTDIR, but got %v", err)
+	}
+}
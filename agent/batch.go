@@ -0,0 +1,251 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sync"
+)
+
+// BatchOptions configure SignBatch and SignStream. They are passed as the
+// crypto.SignerOpts of the batch, which apply to every digest in it.
+type BatchOptions struct {
+	crypto.SignerOpts
+
+	// Conns are further connections to the same gpg-agent to spread the
+	// digests over, each selecting the key once. The key's connection is
+	// always used.
+	Conns []*Conn
+}
+
+// SignResult is the outcome of signing a single digest of a batch.
+type SignResult struct {
+	// Index is the position of the digest in the batch, or in the stream.
+	Index int
+
+	Signature []byte
+	Err       error
+}
+
+// BatchError reports the digests of a batch that couldn't be signed.
+type BatchError struct {
+	// Errs holds the error of each digest, or nil if it was signed.
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	n, first := 0, -1
+	for i, err := range e.Errs {
+		if err != nil {
+			if first < 0 {
+				first = i
+			}
+			n++
+		}
+	}
+
+	if first < 0 {
+		return "github.com/cognitive-i/gpg/agent: batch signed"
+	}
+
+	return fmt.Sprintf("github.com/cognitive-i/gpg/agent: %d of %d signatures failed, digest %d: %s", n, len(e.Errs), first, e.Errs[first])
+}
+
+// SignBatch signs each of digests with this key, as Sign would with opts,
+// but selects the key only once for all of them. The signatures are returned
+// in the order of digests. If any digest can't be signed, its signature is
+// nil and the error is a *BatchError telling why.
+//
+// RSA keys can't sign a batch with PSS. If opts is a *BatchOptions, the
+// digests are spread over its connections as well. Keys obtained from a Pool
+// spread them over the connections of the pool.
+//
+// The connections are locked for the whole batch.
+func (key *Key) SignBatch(digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	return key.SignBatchContext(context.Background(), digests, opts)
+}
+
+// SignBatchContext is like SignBatch, but aborts the batch when ctx is done.
+// The digests not signed by then fail with the error of ctx.
+func (key *Key) SignBatchContext(ctx context.Context, digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	in := make(chan []byte)
+	go func() {
+		defer close(in)
+		for _, digest := range digests {
+			in <- digest
+		}
+	}()
+
+	sigs := make([][]byte, len(digests))
+	var errs []error
+	for res := range key.SignStream(ctx, in, opts) {
+		if res.Err != nil {
+			if errs == nil {
+				errs = make([]error, len(digests))
+			}
+			errs[res.Index] = res.Err
+			continue
+		}
+
+		sigs[res.Index] = res.Signature
+	}
+
+	if errs != nil {
+		return sigs, &BatchError{Errs: errs}
+	}
+
+	return sigs, nil
+}
+
+// SignStream is like SignBatchContext, but signs the digests received from
+// digests as they come in. Exactly one result is sent for each of them,
+// which may be out of order when signing on several connections. The
+// returned channel is closed once digests has been closed and all its
+// digests have been signed, so it must be drained.
+func (key *Key) SignStream(ctx context.Context, digests <-chan []byte, opts crypto.SignerOpts) <-chan SignResult {
+	// Keys obtained from a Pool sign on as many of its connections as
+	// they can get.
+	keys := []*Key{key}
+	if key.pool != nil {
+		for i := 1; i < key.pool.size; i++ {
+			keys = append(keys, key)
+		}
+	}
+
+	if batch, ok := opts.(*BatchOptions); ok {
+		opts = batch.SignerOpts
+		for _, conn := range batch.Conns {
+			if conn != nil && !usesConn(keys, conn) {
+				k := *key
+				k.conn, k.pool = conn, nil
+				keys = append(keys, &k)
+			}
+		}
+	}
+
+	jobs := make(chan signJob)
+	results := make(chan SignResult)
+	go func() {
+		defer close(jobs)
+		i := 0
+		for digest := range digests {
+			jobs <- signJob{index: i, digest: digest}
+			i++
+		}
+	}()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		lastErr error
+	)
+	for _, k := range keys {
+		wg.Add(1)
+		go func(k *Key) {
+			defer wg.Done()
+			if err := k.signJobs(ctx, opts, jobs, results); err != nil {
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+			}
+		}(k)
+	}
+
+	go func() {
+		wg.Wait()
+
+		// Every connection broke down, so fail whatever is left.
+		for job := range jobs {
+			err := ctx.Err()
+			if err == nil {
+				err = lastErr
+			}
+
+			results <- SignResult{Index: job.index, Err: err}
+		}
+
+		close(results)
+	}()
+
+	return results
+}
+
+// usesConn reports whether one of keys is on conn.
+func usesConn(keys []*Key, conn *Conn) bool {
+	for _, key := range keys {
+		if key.conn == conn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signJob is a digest of a batch waiting to be signed.
+type signJob struct {
+	index  int
+	digest []byte
+}
+
+// signJobs signs jobs on a connection of this key until there are none
+// left, selecting the key only once. Errors of single digests are sent as
+// their result. It returns the first error that leaves the connection
+// unusable, after reporting it for the digest it occurred on.
+func (key *Key) signJobs(ctx context.Context, opts crypto.SignerOpts, jobs <-chan signJob, results chan<- SignResult) error {
+	var (
+		conn    *Conn
+		release func()
+	)
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+
+	for job := range jobs {
+		op, err := key.signOp(job.digest, opts)
+		if err != nil {
+			results <- SignResult{Index: job.index, Err: err}
+			continue
+		}
+
+		if conn == nil {
+			if conn, release, err = key.acquire(ctx); err != nil {
+				results <- SignResult{Index: job.index, Err: err}
+				return err
+			}
+
+			if err := conn.RawContext(ctx, nil, "RESET"); err != nil {
+				results <- SignResult{Index: job.index, Err: err}
+				return err
+			}
+
+			if err := conn.RawContext(ctx, nil, "SETKEY %s", key.Keygrip); err != nil {
+				results <- SignResult{Index: job.index, Err: err}
+				return err
+			}
+		}
+
+		var sig []byte
+		err = conn.withPassphrase(ctx, key.passphraseRequest(), key.pinentry, func(inq inquiries) error {
+			// The description only applies to a single PKSIGN.
+			if err := conn.setKeyDesc(ctx, key.pinentry); err != nil {
+				return err
+			}
+
+			var err error
+			sig, err = conn.pksign(ctx, op, inq)
+			return err
+		})
+		if err == nil {
+			sig, err = op.decode(sig)
+		} else if _, ok := err.(Error); !ok {
+			results <- SignResult{Index: job.index, Err: err}
+			return err
+		}
+
+		results <- SignResult{Index: job.index, Signature: sig, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+func TestSignBatch(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	var digests [][]byte
+	for i := 0; i < 5; i++ {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+		digests = append(digests, digest[:])
+	}
+
+	// A digest of the wrong length is refused by gpg-agent, without
+	// failing the rest of the batch.
+	digests[2] = digests[2][:20]
+
+	sigs, err := key.SignBatch(digests, crypto.SHA256)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("SignBatch(): expected a *BatchError, but got %v", err)
+	}
+
+	for i, digest := range digests {
+		if i == 2 {
+			if !errors.Is(batchErr.Errs[i], ErrInvalidValue) {
+				t.Errorf("digest %d: expected ErrInvalidValue, but got %v", i, batchErr.Errs[i])
+			}
+			continue
+		}
+
+		if batchErr.Errs[i] != nil {
+			t.Errorf("digest %d: %s", i, batchErr.Errs[i])
+		} else if err := rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, digest, sigs[i]); err != nil {
+			t.Errorf("digest %d: VerifyPKCS1v15(): %s", i, err)
+		}
+	}
+}
+
+func TestSignStream(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	var conns []*Conn
+	for i := 0; i < 3; i++ {
+		c, err := Dial(s.Socket, nil)
+		if err != nil {
+			t.Fatalf("Dial(): %s", err)
+		}
+		defer c.Close()
+
+		conns = append(conns, c)
+	}
+
+	key, err := conns[0].Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	var digests [][]byte
+	for i := 0; i < 20; i++ {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+		digests = append(digests, digest[:])
+	}
+
+	in := make(chan []byte)
+	go func() {
+		defer close(in)
+		for _, digest := range digests {
+			in <- digest
+		}
+	}()
+
+	var results []SignResult
+	for res := range key.SignStream(context.Background(), in, &BatchOptions{Conns: conns[1:]}) {
+		results = append(results, res)
+	}
+
+	if len(results) != 20 {
+		t.Fatalf("expected 20 results, but got %d", len(results))
+	}
+
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("digest %d: %s", res.Index, res.Err)
+		} else if err := verifyECDSA(&priv.PublicKey, digests[res.Index], res.Signature); err != nil {
+			t.Errorf("digest %d: %s", res.Index, err)
+		}
+	}
+}
+
+func TestSignBatchWithBrokenConnection(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	s.Inject("PKSIGN", agenttest.Fault{Hangup: true})
+
+	digest := sha256.Sum256([]byte("Hello World"))
+	_, err = key.SignBatch([][]byte{digest[:], digest[:], digest[:]}, nil)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("SignBatch(): expected a *BatchError, but got %v", err)
+	}
+
+	for i, err := range batchErr.Errs {
+		if err == nil {
+			t.Errorf("digest %d: expected an error, but got none", i)
+		}
+	}
+}
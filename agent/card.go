@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -46,7 +47,8 @@ type Card struct {
 
 	Subkeys [cardMaxKeyNumber]*CardKey
 
-	conn *Conn
+	conn     *Conn
+	pinentry *PinentryOptions
 }
 
 // The IDs of the different subkeys
@@ -63,6 +65,12 @@ var cardOpenGPGIndex = regexp.MustCompile("^OPENPGP.([0-9]+)$")
 
 // CurrentCard returns the currently connected smartcard, including its subkeys
 func (conn *Conn) CurrentCard() (*Card, error) {
+	return conn.CurrentCardContext(context.Background())
+}
+
+// CurrentCardContext is like CurrentCard, but aborts the operation when ctx is
+// done.
+func (conn *Conn) CurrentCardContext(ctx context.Context) (*Card, error) {
 	var card Card
 	card.conn = conn
 
@@ -77,7 +85,7 @@ func (conn *Conn) CurrentCard() (*Card, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	err := conn.Raw(respFunc, "LEARN --sendinfo --ssh-fpr")
+	err := conn.RawContext(ctx, respFunc, "LEARN --sendinfo --ssh-fpr")
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +94,7 @@ func (conn *Conn) CurrentCard() (*Card, error) {
 		if key == nil {
 			continue
 		}
-		key.Key, err = card.conn.key(key.Keygrip)
+		key.Key, err = card.conn.key(ctx, key.Keygrip)
 		if err != nil {
 			return nil, err
 		}
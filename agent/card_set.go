@@ -1,71 +1,89 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func doInquire(conn *Conn) ResponseFunc {
-	return func(respType, data string) error {
-		if respType == "INQUIRE" {
-			return conn.Raw(nil, "END")
-		}
-		return fmt.Errorf("unexpected: %v %v", respType, data)
-	}
-}
-
 // SetDisplayName sets the display name on the given smart card
 func (card *Card) SetDisplayName(name string) error {
+	return card.SetDisplayNameContext(context.Background(), name)
+}
+
+// SetDisplayNameContext is like SetDisplayName, but aborts the operation when ctx is done.
+func (card *Card) SetDisplayNameContext(ctx context.Context, name string) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
-	return card.conn.Raw(doInquire(card.conn), "scd SETATTR DISP-NAME %v", name)
+	return card.conn.RawContext(ctx, nil, "scd SETATTR DISP-NAME %v", name)
 }
 
 // SetDisplaySex sets the display sex on the given smart card
 func (card *Card) SetDisplaySex(sex CardSex) error {
+	return card.SetDisplaySexContext(context.Background(), sex)
+}
+
+// SetDisplaySexContext is like SetDisplaySex, but aborts the operation when ctx is done.
+func (card *Card) SetDisplaySexContext(ctx context.Context, sex CardSex) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
-	return card.conn.Raw(doInquire(card.conn), "scd SETATTR DISP-SEX %v", sex)
+	return card.conn.RawContext(ctx, nil, "scd SETATTR DISP-SEX %v", sex)
 }
 
 // SetDisplayLanguage sets the display language on the given smart card
 func (card *Card) SetDisplayLanguage(lang string) error {
+	return card.SetDisplayLanguageContext(context.Background(), lang)
+}
+
+// SetDisplayLanguageContext is like SetDisplayLanguage, but aborts the operation when ctx is done.
+func (card *Card) SetDisplayLanguageContext(ctx context.Context, lang string) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
-	return card.conn.Raw(doInquire(card.conn), "scd SETATTR DISP-LANG %v", lang)
+	return card.conn.RawContext(ctx, nil, "scd SETATTR DISP-LANG %v", lang)
 }
 
 // SetLoginData sets the login data on the given smart card
 func (card *Card) SetLoginData(loginData string) error {
+	return card.SetLoginDataContext(context.Background(), loginData)
+}
+
+// SetLoginDataContext is like SetLoginData, but aborts the operation when ctx is done.
+func (card *Card) SetLoginDataContext(ctx context.Context, loginData string) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
-	return card.conn.Raw(doInquire(card.conn), "scd SETATTR LOGIN-DATA %v", loginData)
+	return card.conn.RawContext(ctx, nil, "scd SETATTR LOGIN-DATA %v", loginData)
 }
 
 // FactoryReset will ensure the key is completely wiped out,
 // see https://support.yubico.com/support/solutions/articles/15000006421-resetting-the-openpgp-applet-on-your-yubikey for more information
 func (card *Card) FactoryReset() error {
+	return card.FactoryResetContext(context.Background())
+}
+
+// FactoryResetContext is like FactoryReset, but aborts the operation when ctx
+// is done.
+func (card *Card) FactoryResetContext(ctx context.Context) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
-	err := card.conn.Raw(nil, "scd RESET")
+	err := card.conn.RawContext(ctx, nil, "scd RESET")
 	if err != nil {
 		return err
 	}
-	err = card.conn.Raw(nil, "scd SERIALNO")
+	err = card.conn.RawContext(ctx, nil, "scd SERIALNO")
 	if err != nil {
 		return err
 	}
 	// Retry every PIN 4 times to ensure they are blocked
 	for _, command := range []string{"00200081084040404040404040", "00200083084040404040404040"} {
 		for i := 0; i < 4; i++ {
-			err = card.conn.Raw(func(respType, data string) error {
+			err = card.conn.RawContext(ctx, func(respType, data string) error {
 				if respType == "D" && len(data) == 2 {
 					if int(data[1]) != 0xC0+i {
 						return fmt.Errorf("unexpected answer: %#x", int(data[1]))
@@ -76,15 +94,20 @@ func (card *Card) FactoryReset() error {
 			}, "scd APDU %s", command)
 		}
 	}
-	err = card.conn.Raw(nil, "scd APDU 00e60000")
+	err = card.conn.RawContext(ctx, nil, "scd APDU 00e60000")
 	if err != nil {
 		return err
 	}
-	return card.conn.Raw(nil, "scd APDU 00440000")
+	return card.conn.RawContext(ctx, nil, "scd APDU 00440000")
 }
 
 // ResetPassword will unblock the requested password
 func (card *Card) ResetPassword(admin bool) error {
+	return card.ResetPasswordContext(context.Background(), admin)
+}
+
+// ResetPasswordContext is like ResetPassword, but aborts the operation when ctx is done.
+func (card *Card) ResetPasswordContext(ctx context.Context, admin bool) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
@@ -92,11 +115,18 @@ func (card *Card) ResetPassword(admin bool) error {
 	if admin {
 		id = 3
 	}
-	return card.conn.Raw(doInquire(card.conn), "scd PASSWD --reset %d", id)
+	return card.conn.withPassphrase(ctx, card.pinRequest(true), card.pinentry, func(inq inquiries) error {
+		return card.conn.transact(ctx, nil, inq, "scd PASSWD --reset %d", id)
+	})
 }
 
 // SetPIN will provide a prompt to set the requested password
 func (card *Card) SetPIN(admin bool) error {
+	return card.SetPINContext(context.Background(), admin)
+}
+
+// SetPINContext is like SetPIN, but aborts the operation when ctx is done.
+func (card *Card) SetPINContext(ctx context.Context, admin bool) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
@@ -104,11 +134,18 @@ func (card *Card) SetPIN(admin bool) error {
 	if admin {
 		id = 3
 	}
-	return card.conn.Raw(doInquire(card.conn), "scd PASSWD %d", id)
+	return card.conn.withPassphrase(ctx, card.pinRequest(admin), card.pinentry, func(inq inquiries) error {
+		return card.conn.transact(ctx, nil, inq, "scd PASSWD %d", id)
+	})
 }
 
 // CheckPIN will check the requested password (potentially cached, might need unplugging for subsequent calls)
 func (card *Card) CheckPIN(admin bool) error {
+	return card.CheckPINContext(context.Background(), admin)
+}
+
+// CheckPINContext is like CheckPIN, but aborts the operation when ctx is done.
+func (card *Card) CheckPINContext(ctx context.Context, admin bool) error {
 	card.conn.mu.Lock()
 	defer card.conn.mu.Unlock()
 
@@ -116,11 +153,28 @@ func (card *Card) CheckPIN(admin bool) error {
 	if admin {
 		suffix = "[CHV3]"
 	}
-	return card.conn.Raw(doInquire(card.conn), "scd CHECKPIN %s%s", card.Serial, suffix)
+	return card.conn.withPassphrase(ctx, card.pinRequest(admin), card.pinentry, func(inq inquiries) error {
+		return card.conn.transact(ctx, nil, inq, "scd CHECKPIN %s%s", card.Serial, suffix)
+	})
+}
+
+// pinRequest describes the PIN, or the admin PIN, of this card.
+func (card *Card) pinRequest(admin bool) PassphraseRequest {
+	req := PassphraseRequest{SerialNo: card.Serial, PINRetries: card.PINRetryCounter[0]}
+	if admin {
+		req.PINRetries = card.PINRetryCounter[2]
+	}
+
+	return req
 }
 
 // AddKey will generate a new key on the card
 func (card *Card) AddKey(subKey int) error {
+	return card.AddKeyContext(context.Background(), subKey)
+}
+
+// AddKeyContext is like AddKey, but aborts the operation when ctx is done.
+func (card *Card) AddKeyContext(ctx context.Context, subKey int) error {
 	if subKey >= cardMaxKeyNumber {
 		return fmt.Errorf("invalid key ID %d", subKey)
 	}
@@ -134,11 +188,7 @@ func (card *Card) AddKey(subKey int) error {
 	}
 	card.Subkeys[subKey] = key
 
-	inquireFunc := doInquire(card.conn)
-	err := card.conn.Raw(func(respType, data string) error {
-		if respType == "INQUIRE" {
-			return inquireFunc(respType, data)
-		}
+	genkey := func(respType, data string) error {
 		if respType == "S" {
 			parts := strings.Fields(strings.TrimSpace(data))
 			switch parts[0] {
@@ -157,16 +207,20 @@ func (card *Card) AddKey(subKey int) error {
 			return nil
 		}
 		return fmt.Errorf("unexpected: %v %v", respType, data)
-	}, "scd GENKEY %d", subKey+1)
+	}
+
+	err := card.conn.withPassphrase(ctx, card.pinRequest(true), card.pinentry, func(inq inquiries) error {
+		return card.conn.transact(ctx, genkey, inq, "scd GENKEY %d", subKey+1)
+	})
 	if err != nil {
 		return err
 	}
-	err = card.conn.Raw(nil, "RESET")
+	err = card.conn.RawContext(ctx, nil, "RESET")
 	if err != nil {
 		return err
 	}
 
-	err = card.conn.Raw(func(respType, data string) error {
+	err = card.conn.RawContext(ctx, func(respType, data string) error {
 		if respType != "S" {
 			return nil
 		}
@@ -177,6 +231,6 @@ func (card *Card) AddKey(subKey int) error {
 		return err
 	}
 
-	key.Key, err = card.conn.key(key.Keygrip)
+	key.Key, err = card.conn.key(ctx, key.Keygrip)
 	return err
 }
@@ -2,16 +2,17 @@ package agent
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
-	"os/exec"
-	"regexp"
-
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -19,7 +20,22 @@ var (
 	debug = ioutil.Discard
 )
 
-// ResponseFunc defines the function handler for the Raw function.
+// maxLineLength is the maximum length of an Assuan line, not counting the
+// terminating newline.
+const maxLineLength = 1000
+
+// cancelGrace is how long we wait for gpg-agent to acknowledge a CAN sent in
+// reply to an INQUIRE after the operation's context has been cancelled.
+const cancelGrace = time.Second
+
+// aLongTimeAgo is a non-zero time in the past, used to unblock pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ResponseFunc defines the function handler for the Raw function. respType
+// is "D", "S" or "#" for data, status and comment lines. Inquiries without an
+// InquiryFunc are passed as "INQUIRE" with the keyword and parameters as
+// data; they are answered with no data once f returns nil, and cancelled if
+// it returns an error.
 type ResponseFunc func(respType, data string) error
 
 // Conn represents a single connection to a GPG agent.
@@ -27,56 +43,178 @@ type Conn struct {
 	c  net.Conn
 	r  *bufio.Reader
 	mu sync.Mutex
+
+	inquiryMu sync.RWMutex
+	inquiries inquiries
+
+	statusMu       sync.RWMutex
+	subscribers    map[int]StatusFunc
+	nextSubscriber int
+
+	// options caches the results of GETINFO cmd_has_option.
+	options map[string]bool
+
+	// sessionOptions are the options set by Dial, in order.
+	sessionOptions []string
+
+	// provider answers passphrase inquiries, see WithPinentryLoopback.
+	provider PassphraseProvider
+
+	// err is the error that left the connection unusable, if any.
+	err error
+
+	// closed is set by Close.
+	closed bool
+
+	// sequences counts the sequences of commands in progress, see begin.
+	sequences int
+
+	// unwatch stops the watcher of the command in progress, see watch.
+	unwatch func()
+
+	// filename, dialOpts and cfg are the arguments of Dial, kept to
+	// reconnect.
+	filename string
+	dialOpts []string
+	cfg      *dialConfig
 }
 
+// errClosed is returned by commands issued on a closed connection.
+var errClosed = errors.New("github.com/cognitive-i/gpg/agent: use of closed connection")
+
 // Dial connects to the specified unix domain socket and checks if there is a
 // live GPG agent on the other end.
-// If filename is "", try to find the path the socket automatically
-// by calling gpgconf --list-dirs (see findAgentSocket).
-func Dial(filename string, options []string) (*Conn, error) {
-	if filename == "" {
+// If filename is "", the path of the socket is resolved the way GnuPG does
+// it (see SocketPath), taking the DialOptions into account.
+func Dial(filename string, options []string, opts ...DialOption) (*Conn, error) {
+	return DialContext(context.Background(), filename, options, opts...)
+}
+
+// DialContext is like Dial, but gives up connecting and greeting the agent
+// when ctx is done.
+func DialContext(ctx context.Context, filename string, options []string, opts ...DialOption) (*Conn, error) {
+	conn := &Conn{
+		filename: filename,
+		dialOpts: append([]string(nil), options...),
+		cfg:      newDialConfig(opts),
+	}
+
+	if err := conn.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// connect dials gpg-agent and sets up the session as requested by Dial.
+func (conn *Conn) connect(ctx context.Context) error {
+	cfg := conn.cfg
+	socket := conn.filename
+	if socket == "" {
 		var err error
-		filename, err = findAgentSocket()
+		socket, err = SocketPath(cfg.homedir, cfg.socket)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	c, err := net.Dial("unix", filename)
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", socket)
+	if err != nil && cfg.autostart && ctx.Err() == nil && agentMissing(err) {
+		c, err = startAgent(ctx, cfg, conn.filename)
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	conn := &Conn{c: c, r: bufio.NewReader(c)}
-	if err = conn.response(func(string, string) error { return nil }); err != nil {
-		return nil, err
+	conn.c, conn.r, conn.err = c, bufio.NewReader(c), nil
+	conn.options, conn.sessionOptions = nil, nil
+
+	if err := conn.setup(ctx); err != nil {
+		conn.fail(err)
+		_ = c.Close()
+		return err
+	}
+
+	return nil
+}
+
+// setup reads the greeting of gpg-agent and sets the options of the session.
+func (conn *Conn) setup(ctx context.Context) error {
+	cfg := conn.cfg
+	stop := conn.watch(ctx)
+	err := conn.response(ctx, nil, nil)
+	stop()
+	if err != nil {
+		return err
+	}
+
+	options := conn.dialOpts
+	if cfg.session != nil {
+		session, err := cfg.session.options()
+		if err != nil {
+			return err
+		}
+
+		options = append(session, options...)
 	}
 
 	for _, option := range options {
-		if err := conn.Raw(nil, "OPTION %s", option); err != nil {
-			return nil, err
+		if err := conn.RawContext(ctx, nil, "OPTION %s", option); err != nil {
+			return err
 		}
+
+		conn.sessionOptions = append(conn.sessionOptions, option)
 	}
 
-	return conn, nil
+	if cfg.loopback {
+		if err := conn.RawContext(ctx, nil, "OPTION pinentry-mode=loopback"); err != nil {
+			return err
+		}
+
+		conn.sessionOptions = append(conn.sessionOptions, "pinentry-mode=loopback")
+		conn.provider = cfg.provider
+	}
+
+	if cfg.session != nil && cfg.session.UpdateStartupTTY {
+		if err := conn.RawContext(ctx, nil, "UPDATESTARTUPTTY"); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Find the agent socket by calling the gpgconf program and parse its output
-func findAgentSocket() (string, error) {
-	re := regexp.MustCompile("agent-socket:(.*)\n")
+// splitOption splits an Assuan option of the form name=value or name value.
+func splitOption(option string) (name, value string) {
+	i := strings.IndexAny(option, "= ")
+	if i < 0 {
+		return strings.TrimPrefix(option, "--"), ""
+	}
 
-	out, err := exec.Command("gpgconf", "--list-dirs").Output()
-	if err != nil {
-		return "", err
+	return strings.TrimPrefix(strings.TrimSpace(option[:i]), "--"), strings.TrimSpace(option[i+1:])
+}
+
+// sessionOption returns the value of the option name as set by Dial, and
+// whether it was set at all.
+func (conn *Conn) sessionOption(name string) (string, bool) {
+	value, ok := "", false
+	for _, option := range conn.sessionOptions {
+		if n, v := splitOption(option); n == name {
+			value, ok = v, true
+		}
 	}
 
-	filename := re.FindStringSubmatch(string(out))
+	return value, ok
+}
 
-	if filename == nil {
-		return "", errors.New("agent-socket path not found in gpgconf output")
+// pinentryMode returns the pinentry-mode of the session, as set by Dial.
+func (conn *Conn) pinentryMode() string {
+	if mode, _ := conn.sessionOption("pinentry-mode"); mode != "" {
+		return mode
 	}
 
-	return filename[1], nil
+	return "default"
 }
 
 // request sends a request to the pgp-agent and then returns its response.
@@ -85,54 +223,308 @@ func (conn *Conn) request(format string, a ...interface{}) error {
 	_, _ = fmt.Fprintf(debug, "> %s", req)
 
 	_, err := conn.c.Write([]byte(req))
+	if err != nil {
+		conn.fail(err)
+	}
+
 	return err
 }
 
-// response reads the gpg-agent's response after a request has been issued.
-func (conn *Conn) response(f ResponseFunc) error {
-	var funcErr error
-	if f == nil {
-		f = func(respType, data string) error { return nil }
+// fail marks the connection as unusable because of err, unless it already
+// is.
+func (conn *Conn) fail(err error) {
+	if conn.err == nil {
+		conn.err = err
+	}
+}
+
+// broken reports whether the connection has become unusable, because it was
+// closed or its I/O failed.
+func (conn *Conn) broken() bool {
+	return conn.err != nil
+}
+
+// dataWriter escapes everything written to it and sends it to gpg-agent as
+// D lines that stay within the Assuan line length limit.
+type dataWriter struct {
+	conn *Conn
+	line []byte
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		escape := c == '%' || c == '\r' || c == '\n'
+
+		n := 1
+		if escape {
+			n = 3
+		}
+
+		if len(w.line)+n > maxLineLength {
+			if err := w.flush(); err != nil {
+				return i, err
+			}
+		}
+
+		if len(w.line) == 0 {
+			w.line = append(w.line, "D "...)
+		}
+
+		if escape {
+			w.line = append(w.line, '%', hexDigits[c>>4], hexDigits[c&0x0f])
+		} else {
+			w.line = append(w.line, c)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *dataWriter) flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+
+	_, _ = fmt.Fprintf(debug, "> %s\n", w.line)
+
+	line := append(w.line, '\n')
+	_, err := w.conn.c.Write(line)
+	if err != nil {
+		w.conn.fail(err)
+	}
+
+	// The data may be a passphrase, so don't leave it behind.
+	wipe(line)
+	wipe(w.line)
+	w.line = w.line[:0]
+	return err
+}
+
+// Close sends any buffered data and terminates it with END.
+func (w *dataWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	return w.conn.request("END")
+}
+
+// watch interrupts any pending I/O on the connection once ctx is done, and
+// applies the deadline of ctx to it. The returned function must be called
+// when the command has completed; it may be called more than once.
+func (conn *Conn) watch(ctx context.Context) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.c.SetDeadline(deadline)
+	}
+
+	if ctx.Done() == nil {
+		conn.unwatch = func() {}
+		return conn.unwatch
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			_ = conn.c.SetDeadline(aLongTimeAgo)
+		case <-quit:
+		}
+	}()
+
+	var once sync.Once
+	conn.unwatch = func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+		_ = conn.c.SetDeadline(time.Time{})
+	}
+
+	return conn.unwatch
+}
+
+// contextErr maps an I/O error caused by the watcher of ctx to the error of
+// ctx itself. Any other error is returned unchanged.
+func contextErr(ctx context.Context, err error) error {
+	if err == nil || ctx.Done() == nil {
+		return err
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return context.DeadlineExceeded
 	}
 
+	return err
+}
+
+// cancelInquiry answers a pending INQUIRE with CAN so gpg-agent aborts the
+// current command while keeping the connection usable. The watcher of the
+// command is stopped first, so it can't move the deadline to the past again,
+// and the deadline is extended a little to read the answer to CAN.
+func (conn *Conn) cancelInquiry() error {
+	if conn.unwatch != nil {
+		conn.unwatch()
+	}
+	_ = conn.c.SetDeadline(time.Now().Add(cancelGrace))
+	return conn.request("CAN")
+}
+
+// abort closes the underlying connection after a command has been
+// interrupted halfway, as there is no way to tell gpg-agent to stop it.
+func (conn *Conn) abort() {
+	conn.fail(errClosed)
+	_ = conn.c.Close()
+}
+
+// reply reads the gpg-agent's response to a single command.
+type reply struct {
+	conn *Conn
+	ctx  context.Context
+	f    ResponseFunc
+	inq  inquiries
+
+	// err is the first error returned by f or an inquiry handler. Once set,
+	// the rest of the response is read but ignored.
+	err error
+
+	// received is set once any line of the response has been read.
+	received bool
+}
+
+// next processes the response up to and including the next D line and
+// returns its decoded payload. At the end of the response it returns io.EOF
+// on success, or the error the command failed with.
+func (r *reply) next() ([]byte, error) {
 	for {
-		line, err := conn.r.ReadString('\n')
+		line, err := r.conn.r.ReadBytes('\n')
 		if err != nil {
-			return err
+			// io.EOF is reserved for the end of a successful response.
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			if err = contextErr(r.ctx, err); err != context.Canceled && err != context.DeadlineExceeded {
+				r.conn.fail(err)
+				return nil, err
+			}
+
+			r.conn.abort()
+			return nil, err
 		}
 
 		_, _ = fmt.Fprintf(debug, "< %s", line)
+		r.received = true
 
-		line = strings.TrimSpace(line)
+		line = bytes.TrimRight(line, "\r\n")
 		switch {
-		case line == "OK" || strings.HasPrefix(line, "OK "):
-			return funcErr
+		case isLine(line, "OK"):
+			if r.err != nil {
+				return nil, r.err
+			}
 
-		case strings.HasPrefix(line, "ERR "):
-			if funcErr != nil {
-				return funcErr
+			return nil, io.EOF
+
+		case isLine(line, "ERR"):
+			if r.err != nil {
+				return nil, r.err
 			}
 
-			return NewError(line)
-		}
+			return nil, NewError(string(line))
+
+		case isLine(line, "INQUIRE"):
+			if r.err == nil {
+				r.err = r.ctx.Err()
+			}
+
+			if r.err == nil {
+				inq := parseInquiry(string(lineParams(line)))
+				if inq.Keyword == InquirePinentryLaunched {
+					r.conn.publish(parseStatus(inq.Keyword + " " + inq.Params))
+				}
+
+				// Let the caller see inquiries nobody else answers, as
+				// before inquiry handlers existed.
+				if r.conn.handler(inq.Keyword, r.inq) == nil {
+					r.err = r.f("INQUIRE", string(lineParams(line)))
+				}
+
+				if r.err == nil {
+					if r.err = r.conn.inquire(r.ctx, inq, r.inq); r.err == nil {
+						continue
+					}
+				}
+			}
+
+			// The inquiry can't be answered, so cancel it rather than have
+			// gpg-agent wait for us indefinitely.
+			if err := r.conn.cancelInquiry(); err != nil {
+				r.conn.abort()
+				return nil, err
+			}
+
+		case isLine(line, "D"):
+			if r.err == nil {
+				return unescape(lineParams(line)), nil
+			}
+
+		case isLine(line, "S"):
+			r.conn.publish(parseStatus(string(lineParams(line))))
+			if r.err == nil {
+				r.err = r.f("S", string(lineParams(line)))
+			}
 
-		if funcErr != nil {
-			continue
+		case isLine(line, "#"):
+			if r.err == nil {
+				r.err = r.f("#", string(lineParams(line)))
+			}
 		}
+	}
+}
 
-		switch {
-		case strings.HasPrefix(line, "S "):
-			funcErr = f("S", line[2:])
+// isLine reports whether line is of the specified Assuan line type.
+func isLine(line []byte, lineType string) bool {
+	return bytes.HasPrefix(line, []byte(lineType)) &&
+		(len(line) == len(lineType) || line[len(lineType)] == ' ')
+}
 
-		case strings.HasPrefix(line, "D "):
-			funcErr = f("D", decode(line[2:]))
+// lineParams returns everything following the line type of an Assuan line.
+func lineParams(line []byte) []byte {
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		return line[i+1:]
+	}
 
-		case strings.HasPrefix(line, "INQUIRE "):
-			funcErr = f("INQUIRE", line[8:])
+	return nil
+}
 
-		case strings.HasPrefix(line, "# "):
-			funcErr = f("#", line[2:])
+// response reads the gpg-agent's response after a request has been issued.
+// Inquiries are answered by the handlers in inq, falling back on the ones
+// registered with HandleInquiry.
+func (conn *Conn) response(ctx context.Context, f ResponseFunc, inq inquiries) error {
+	if f == nil {
+		f = func(respType, data string) error { return nil }
+	}
+
+	r := reply{conn: conn, ctx: ctx, f: f, inq: inq}
+	return r.run()
+}
+
+// run reads the whole response, piping its data to r.f.
+func (r *reply) run() error {
+	for {
+		data, err := r.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
+
+		r.err = r.f("D", string(data))
 	}
 }
 
@@ -142,6 +534,8 @@ func (conn *Conn) Close() error {
 	defer conn.mu.Unlock()
 
 	conn.r = nil
+	conn.closed = true
+	conn.fail(errClosed)
 	return conn.c.Close()
 }
 
@@ -199,13 +593,18 @@ func keyScan(key *Key, line string) error {
 
 // Key returns the key information for the key with the specified keygrip.
 func (conn *Conn) Key(keygrip string) (Key, error) {
+	return conn.KeyContext(context.Background(), keygrip)
+}
+
+// KeyContext is like Key, but aborts the operation when ctx is done.
+func (conn *Conn) KeyContext(ctx context.Context, keygrip string) (Key, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	return conn.key(keygrip)
+	return conn.key(ctx, keygrip)
 }
 
-func (conn *Conn) key(keygrip string) (Key, error) {
+func (conn *Conn) key(ctx context.Context, keygrip string) (Key, error) {
 	var key Key
 	respFunc := func(respType, data string) (err error) {
 		if respType != "S" || !strings.HasPrefix(data, "KEYINFO ") {
@@ -215,13 +614,13 @@ func (conn *Conn) key(keygrip string) (Key, error) {
 		return keyScan(&key, data)
 	}
 
-	err := conn.Raw(respFunc, "KEYINFO --ssh-fpr %s", keygrip)
+	err := conn.RawContext(ctx, respFunc, "KEYINFO --ssh-fpr %s", keygrip)
 	if err != nil {
 		return Key{}, err
 	}
 
 	key.conn = conn
-	if key.publicKey, err = conn.readKey(key.Keygrip); err != nil {
+	if key.publicKey, err = conn.readKey(ctx, key.Keygrip); err != nil {
 		return Key{}, err
 	}
 
@@ -230,6 +629,11 @@ func (conn *Conn) key(keygrip string) (Key, error) {
 
 // Keys returns a list of available keys.
 func (conn *Conn) Keys() ([]Key, error) {
+	return conn.KeysContext(context.Background())
+}
+
+// KeysContext is like Keys, but aborts the operation when ctx is done.
+func (conn *Conn) KeysContext(ctx context.Context) ([]Key, error) {
 	var keyList []Key
 	respFunc := func(respType, data string) error {
 		if respType != "S" || !strings.HasPrefix(data, "KEYINFO ") {
@@ -248,14 +652,14 @@ func (conn *Conn) Keys() ([]Key, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	err := conn.Raw(respFunc, "KEYINFO --list --ssh-fpr")
+	err := conn.RawContext(ctx, respFunc, "KEYINFO --list --ssh-fpr")
 	if err != nil {
 		return nil, err
 	}
 
 	for i, key := range keyList {
 		keyList[i].conn = conn
-		if keyList[i].publicKey, err = conn.readKey(key.Keygrip); err != nil {
+		if keyList[i].publicKey, err = conn.readKey(ctx, key.Keygrip); err != nil {
 			return nil, err
 		}
 	}
@@ -265,6 +669,11 @@ func (conn *Conn) Keys() ([]Key, error) {
 
 // KeyGrips returns a list of available keysgrips, indexed by CardID, by querying the card
 func (conn *Conn) KeyGrips() (map[string]string, error) {
+	return conn.KeyGripsContext(context.Background())
+}
+
+// KeyGripsContext is like KeyGrips, but aborts the operation when ctx is done.
+func (conn *Conn) KeyGripsContext(ctx context.Context) (map[string]string, error) {
 	grips := map[string]string{}
 
 	scan := func(key *Key, line string) error {
@@ -302,7 +711,7 @@ func (conn *Conn) KeyGrips() (map[string]string, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	err := conn.Raw(respFunc, "scd LEARN --force")
+	err := conn.RawContext(ctx, respFunc, "scd LEARN --force")
 	if err != nil {
 		return nil, err
 	}
@@ -311,62 +720,229 @@ func (conn *Conn) KeyGrips() (map[string]string, error) {
 }
 
 // Raw executes a command and pipes its results to the specified ResponseFunc
-// parameter.
+// parameter. Inquiries made by gpg-agent during the command are answered by
+// the handlers registered with HandleInquiry. Any other inquiry is passed to
+// f and then answered with no data, as f has no way to send any.
 func (conn *Conn) Raw(f ResponseFunc, format string, a ...interface{}) error {
-	if err := conn.request(format, a...); err != nil {
+	return conn.RawContext(context.Background(), f, format, a...)
+}
+
+// RawContext is like Raw, but aborts the command when ctx is done. If the
+// agent is waiting on an INQUIRE at that point, the inquiry is cancelled and
+// the connection remains usable; otherwise the connection is closed, since
+// there is no other way to interrupt a running command.
+func (conn *Conn) RawContext(ctx context.Context, f ResponseFunc, format string, a ...interface{}) error {
+	return conn.transact(ctx, f, nil, format, a...)
+}
+
+// transact is like RawContext, but lets the caller answer inquiries specific
+// to this command through inq.
+func (conn *Conn) transact(ctx context.Context, f ResponseFunc, inq inquiries, format string, a ...interface{}) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	return conn.response(f)
+	if f == nil {
+		f = func(respType, data string) error { return nil }
+	}
+
+	line := fmt.Sprintf(format, a...)
+	for retried := false; ; retried = true {
+		if err := conn.ready(ctx); err != nil {
+			return err
+		}
+
+		r := reply{conn: conn, ctx: ctx, f: f, inq: inq}
+		err := conn.roundTrip(&r, line)
+		if err == nil || retried || !conn.retryable(&r, line) {
+			return err
+		}
+	}
 }
 
-// ReadKey returns the public key for the key with the specified keygrip.
-func (conn *Conn) ReadKey(keygrip string) (crypto.PublicKey, error) {
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
+// roundTrip sends the command line and reads the response to it with r.
+func (conn *Conn) roundTrip(r *reply, line string) error {
+	stop := conn.watch(r.ctx)
+	defer stop()
+
+	if err := conn.request("%s", line); err != nil {
+		return contextErr(r.ctx, err)
+	}
 
-	return conn.readKey(keygrip)
+	return r.run()
 }
 
-func (conn *Conn) readKey(keygrip string) (crypto.PublicKey, error) {
-	var key string
-	respFunc := func(respType, data string) error {
+// RawData executes a command and returns all data it sent back, with the
+// payloads of consecutive D lines concatenated. Status and comment lines are
+// piped to f.
+func (conn *Conn) RawData(f ResponseFunc, format string, a ...interface{}) ([]byte, error) {
+	return conn.RawDataContext(context.Background(), f, format, a...)
+}
+
+// RawDataContext is like RawData, but aborts the command when ctx is done.
+func (conn *Conn) RawDataContext(ctx context.Context, f ResponseFunc, format string, a ...interface{}) ([]byte, error) {
+	return conn.collect(ctx, f, nil, format, a...)
+}
+
+// collect is like RawDataContext, but lets the caller answer inquiries
+// specific to this command through inq.
+func (conn *Conn) collect(ctx context.Context, f ResponseFunc, inq inquiries, format string, a ...interface{}) ([]byte, error) {
+	var data []byte
+	respFunc := func(respType, d string) error {
 		if respType == "D" {
-			key = data
+			data = append(data, d...)
+			return nil
+		}
+
+		if f != nil {
+			return f(respType, d)
 		}
 
 		return nil
 	}
 
-	if err := conn.Raw(respFunc, "READKEY %s", keygrip); err != nil {
+	if err := conn.transact(ctx, respFunc, inq, format, a...); err != nil {
 		return nil, err
 	}
 
-	publicKey, err := decodeRSAPublicKey(key)
-	if err != nil {
+	return data, nil
+}
+
+// RawReader executes a command and returns a reader streaming the data it
+// sends back. Status and comment lines are piped to f as they are read.
+// Reading returns io.EOF when the command succeeded, or the error it failed
+// with. The reader must be closed before the connection is used again;
+// closing it early discards the rest of the response.
+func (conn *Conn) RawReader(f ResponseFunc, format string, a ...interface{}) (io.ReadCloser, error) {
+	return conn.RawReaderContext(context.Background(), f, format, a...)
+}
+
+// RawReaderContext is like RawReader, but aborts the command when ctx is
+// done.
+func (conn *Conn) RawReaderContext(ctx context.Context, f ResponseFunc, format string, a ...interface{}) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	return publicKey, nil
+	if err := conn.ready(ctx); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		f = func(respType, data string) error { return nil }
+	}
+
+	stop := conn.watch(ctx)
+	if err := conn.request(format, a...); err != nil {
+		stop()
+		return nil, contextErr(ctx, err)
+	}
+
+	return &dataReader{r: reply{conn: conn, ctx: ctx, f: f}, stop: stop}, nil
 }
 
-// Version returns the version number of gpg-agent.
-func (conn *Conn) Version() (string, error) {
-	var version string
-	respFunc := func(respType, data string) error {
-		if respType == "D" {
-			version = data
+// dataReader streams the data of a response.
+type dataReader struct {
+	r    reply
+	buf  []byte
+	err  error
+	stop func()
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 && d.err == nil {
+		if d.buf, d.err = d.r.next(); d.err != nil {
+			d.stop()
 		}
+	}
 
+	if len(d.buf) > 0 {
+		n := copy(p, d.buf)
+		d.buf = d.buf[n:]
+		return n, nil
+	}
+
+	return 0, d.err
+}
+
+func (d *dataReader) Close() error {
+	d.buf = nil
+	for d.err == nil {
+		if _, d.err = d.r.next(); d.err != nil {
+			d.stop()
+		}
+	}
+
+	if d.err == io.EOF {
 		return nil
 	}
 
+	return d.err
+}
+
+// ReadKey returns the public key for the key with the specified keygrip.
+func (conn *Conn) ReadKey(keygrip string) (crypto.PublicKey, error) {
+	return conn.ReadKeyContext(context.Background(), keygrip)
+}
+
+// ReadKeyContext is like ReadKey, but aborts the operation when ctx is done.
+func (conn *Conn) ReadKeyContext(ctx context.Context, keygrip string) (crypto.PublicKey, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.readKey(ctx, keygrip)
+}
+
+func (conn *Conn) readKey(ctx context.Context, keygrip string) (crypto.PublicKey, error) {
+	key, err := conn.RawDataContext(ctx, nil, "READKEY %s", keygrip)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := decodePublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKey, nil
+}
+
+// Version returns the version number of gpg-agent.
+func (conn *Conn) Version() (string, error) {
+	return conn.VersionContext(context.Background())
+}
+
+// VersionContext is like Version, but aborts the operation when ctx is done.
+func (conn *Conn) VersionContext(ctx context.Context) (string, error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	if err := conn.Raw(respFunc, "GETINFO version"); err != nil {
+	version, err := conn.RawDataContext(ctx, nil, "GETINFO version")
+	if err != nil {
 		return "", err
 	}
 
-	return version, nil
+	return string(version), nil
+}
+
+// hasOption reports whether gpg-agent supports option for the command cmd.
+// The answer is cached for the lifetime of the connection. The caller must
+// hold conn.mu.
+func (conn *Conn) hasOption(ctx context.Context, cmd, option string) (bool, error) {
+	name := cmd + " " + option
+	if supported, ok := conn.options[name]; ok {
+		return supported, nil
+	}
+
+	err := conn.RawContext(ctx, nil, "GETINFO cmd_has_option %s %s", cmd, option)
+	if _, ok := err.(Error); err != nil && !ok {
+		return false, err
+	}
+
+	if conn.options == nil {
+		conn.options = map[string]bool{}
+	}
+	conn.options[name] = err == nil
+
+	return err == nil, nil
 }
@@ -1,33 +1,73 @@
 package agent
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cognitive-i/gpg"
+	"github.com/cognitive-i/gpg/agent/agenttest"
 )
 
-var conn *Conn
+// testdataKeygrips are the keys of the testdata keyring.
+var testdataKeygrips = []string{
+	"FF47135C1C28599504C27AC6AE1117B6E02079BD", // Primary key
+	"C729393956A1361239C64EFB3DAC4D3735A003ED", // Signing key
+	"3F0803C0B90C2F86A1153F7CC9ACC11AF1CCDA70", // Encryption key
+	"805E7F4F2E2990424218F11EBCEB53B6C6FAF2F4", // Authentication key
+}
+
+// dialGpgAgent connects to a real gpg-agent serving the testdata keyring. The
+// test is skipped if GnuPG isn't installed.
+func dialGpgAgent(t *testing.T) *Conn {
+	t.Helper()
 
-func init() {
-	options := []string{
-		"allow-pinentry-notify",
-		"agent-awareness=2.1.0",
+	if _, err := exec.LookPath("gpg-agent"); err != nil {
+		t.Skip("gpg-agent is not installed")
 	}
 
 	socketFilename, err := StartGpgAgent()
-	if err == nil {
-		conn, err = Dial(socketFilename, options)
+	if err != nil {
+		t.Fatalf("StartGpgAgent(): %s", err)
 	}
 
+	c, err := Dial(socketFilename, []string{"allow-pinentry-notify", "agent-awareness=2.1.0"})
 	if err != nil {
-		panic(err.Error())
+		t.Fatalf("Dial(): %s", err)
 	}
+
+	return c
 }
 
 func TestKey(t *testing.T) {
-	keygrip := "C729393956A1361239C64EFB3DAC4D3735A003ED"
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
 
-	key, err := conn.Key(keygrip)
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	key, err := c.Key(keygrip)
 	if err != nil {
 		t.Fatalf("Key(%s): %s", keygrip, err)
 	}
@@ -38,21 +78,40 @@ func TestKey(t *testing.T) {
 }
 
 func TestKeyWithUnknownKeygrip(t *testing.T) {
-	_, err := conn.Key("0000000000000000000000000000000000000000")
-	switch v := err.(type) {
-	case nil:
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	_, err := c.Key("0000000000000000000000000000000000000000")
+	if err == nil {
 		t.Fatal("expected error on Key() call with invalid keygrip, but got none")
-	case Error:
-		if v.Code != 67108891 {
-			t.Fatalf("expected error code 67108891, but got %d instead", v.Code)
-		}
-	default:
-		t.Fatalf("expected a gpg-agent error, but got this error instead: %s", err)
+	}
+
+	if !IsNoSecretKey(err) {
+		t.Fatalf("expected a missing key error, but got this error instead: %s", err)
 	}
 }
 
 func TestKeys(t *testing.T) {
-	keys, err := conn.Keys()
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	expected := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey(): %s", err)
+		}
+
+		keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+		if err != nil {
+			t.Fatalf("AddKey(): %s", err)
+		}
+		expected[keygrip] = true
+	}
+
+	keys, err := c.Keys()
 	if err != nil {
 		t.Fatalf("Keylist(): %s", err)
 	}
@@ -62,21 +121,61 @@ func TestKeys(t *testing.T) {
 	}
 
 	for _, key := range keys {
-		switch key.Keygrip {
-		case "FF47135C1C28599504C27AC6AE1117B6E02079BD": // Primary key
-		case "C729393956A1361239C64EFB3DAC4D3735A003ED": // Signing key
-		case "3F0803C0B90C2F86A1153F7CC9ACC11AF1CCDA70": // Encryption key
-		case "805E7F4F2E2990424218F11EBCEB53B6C6FAF2F4": // Authentication key
-		default:
+		if !expected[key.Keygrip] {
 			t.Fatalf("%s: unknown keygrip returned by Keylist()", key.Keygrip)
 		}
 	}
 }
 
+func TestKeysWithGpgAgent(t *testing.T) {
+	c := dialGpgAgent(t)
+	defer c.Close()
+
+	keys, err := c.Keys()
+	if err != nil {
+		t.Fatalf("Keylist(): %s", err)
+	}
+
+	if numKeys := len(keys); numKeys != len(testdataKeygrips) {
+		t.Fatalf("expected %d keys, but got %d", len(testdataKeygrips), numKeys)
+	}
+
+	for _, keygrip := range testdataKeygrips {
+		publicKey, err := c.ReadKey(keygrip)
+		if err != nil {
+			t.Fatalf("ReadKey(%s): %s", keygrip, err)
+		}
+
+		if kg := gpg.Keygrip(publicKey); kg != keygrip {
+			t.Errorf("expected keygrip %q, but got %q", keygrip, kg)
+		}
+	}
+
+	if _, err := c.Key("0000000000000000000000000000000000000000"); !IsNoSecretKey(err) {
+		t.Errorf("expected a missing key error, but got %v", err)
+	}
+
+	if _, err := c.ReadKey("0000000000000000000000000000000000000000"); !errors.Is(err, ErrNoEntry) {
+		t.Errorf("expected %v, but got %v", ErrNoEntry, err)
+	}
+}
+
 func TestReadKey(t *testing.T) {
-	keygrip := "FF47135C1C28599504C27AC6AE1117B6E02079BD"
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
 
-	publicKey, err := conn.ReadKey(keygrip)
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	publicKey, err := c.ReadKey(keygrip)
 	if err != nil {
 		t.Fatalf("ReadKey(%s): %s", keygrip, err)
 	}
@@ -87,26 +186,256 @@ func TestReadKey(t *testing.T) {
 }
 
 func TestReadKeyWithUnknownKeygrip(t *testing.T) {
-	_, err := conn.ReadKey("0000000000000000000000000000000000000000")
-	switch v := err.(type) {
-	case nil:
-		t.Fatal("expected error on Key() call with invalid keygrip, but got none")
-	case Error:
-		if v.Code != 67141713 {
-			t.Fatalf("expected error code 67141713, but got %d instead", v.Code)
-		}
-	default:
-		t.Fatalf("expected a gpg-agent error, but got this error instead: %s", err)
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	_, err := c.ReadKey("0000000000000000000000000000000000000000")
+	if err == nil {
+		t.Fatal("expected error on ReadKey() call with invalid keygrip, but got none")
+	}
+
+	if !errors.Is(err, ErrNoEntry) {
+		t.Fatalf("expected %v, but got this error instead: %s", ErrNoEntry, err)
 	}
 }
 
 func TestVersion(t *testing.T) {
-	version, err := conn.Version()
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	version, err := c.Version()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if version != agenttest.DefaultVersion {
+		t.Errorf("expected version %q, but got %q", agenttest.DefaultVersion, version)
+	}
+}
+
+func TestRawContextCancelled(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.VersionContext(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, but got %v", context.Canceled, err)
+	}
+
+	// The connection must still be usable, since nothing was sent.
+	if _, err := c.Version(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// dialScripted connects to a stand-in agent that greets the client and then
+// hands the connection over to serve.
+func dialScripted(t *testing.T, serve func(r *bufio.Reader, w io.Writer)) *Conn {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "S.gpg-agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer os.RemoveAll(dir)
+		defer listener.Close()
+
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		_, _ = c.Write([]byte("OK Pleased to meet you\n"))
+		serve(bufio.NewReader(c), c)
+	}()
+
+	scripted, err := Dial(listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+
+	return scripted
+}
+
+func TestRawContextDeadline(t *testing.T) {
+	// An agent that never answers anything.
+	hung := dialScripted(t, func(r *bufio.Reader, w io.Writer) {
+		_, _ = io.Copy(ioutil.Discard, r)
+	})
+	defer hung.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := hung.KeyContext(ctx, "C729393956A1361239C64EFB3DAC4D3735A003ED"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+// cancelledInquiry inquires a passphrase for INQ commands and answers CAN the
+// way gpg-agent does. Any other command succeeds.
+func cancelledInquiry(r *bufio.Reader, w io.Writer) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch strings.TrimSpace(line) {
+		case "INQ":
+			_, _ = io.WriteString(w, "INQUIRE PASSPHRASE\n")
+		case "CAN":
+			_, _ = io.WriteString(w, "ERR 83886179 Operation cancelled <Unspecified source>\n")
+		default:
+			_, _ = io.WriteString(w, "OK\n")
+		}
+	}
+}
+
+func TestRawContextCancelledDuringInquiry(t *testing.T) {
+	scripted := dialScripted(t, cancelledInquiry)
+	defer scripted.Close()
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := scripted.RawContext(ctx, func(respType, data string) error {
+			cancel()
+			return ctx.Err()
+		}, "INQ")
+		if err != context.Canceled {
+			t.Fatalf("expected %v, but got %v", context.Canceled, err)
+		}
+
+		// The inquiry was cancelled with CAN, so the connection must
+		// still be usable.
+		if err := scripted.Raw(nil, "NOP"); err != nil {
+			t.Fatalf("NOP after cancelling: %s", err)
+		}
+	}
+}
+
+// splitData answers any command with the same data spread over several D
+// lines, interleaved with status lines.
+func splitData(r *bufio.Reader, w io.Writer) {
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+
+		_, _ = io.WriteString(w, "D (10:public-key\nS PROGRESS primegen X 1 3\nD (3:rsa(1:n3:%00%0A%25)\nD (1:e1: ))\nOK\n")
+	}
+}
+
+func TestRawData(t *testing.T) {
+	scripted := dialScripted(t, splitData)
+	defer scripted.Close()
+
+	var status []string
+	data, err := scripted.RawData(func(respType, data string) error {
+		status = append(status, respType+" "+data)
+		return nil
+	}, "READKEY 0000000000000000000000000000000000000000")
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
-	if len(version) == 0 {
-		t.Errorf("expected a version string to return, but got nothing")
+	if expected := "(10:public-key(3:rsa(1:n3:\x00\n%)(1:e1: ))"; string(data) != expected {
+		t.Errorf("expected %q, but got %q", expected, data)
+	}
+
+	if len(status) != 1 || status[0] != "S PROGRESS primegen X 1 3" {
+		t.Errorf("unexpected status lines %q", status)
+	}
+}
+
+func TestRawReader(t *testing.T) {
+	scripted := dialScripted(t, splitData)
+	defer scripted.Close()
+
+	r, err := scripted.RawReader(nil, "READKEY 0000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := "(10:public-key(3:rsa(1:n3:\x00\n%)(1:e1: ))"; string(data) != expected {
+		t.Errorf("expected %q, but got %q", expected, data)
+	}
+
+	// Closing a reader early discards the rest of the response.
+	r, err = scripted.RawReader(nil, "READKEY 0000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := scripted.RawData(nil, "READKEY 0000000000000000000000000000000000000000"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestDataWriterSplitsLines(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	go func() {
+		w := &dataWriter{conn: &Conn{c: client}}
+		_, _ = w.Write(data[:1234])
+		_, _ = w.Write(data[1234:])
+		_ = w.Close()
+	}()
+
+	var received []byte
+	r := bufio.NewReader(server)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		line = line[:len(line)-1]
+		if len(line) > maxLineLength {
+			t.Errorf("line of %d bytes exceeds the line length limit", len(line))
+		}
+
+		if string(line) == "END" {
+			break
+		} else if !isLine(line, "D") {
+			t.Fatalf("unexpected line %q", line)
+		}
+
+		received = append(received, unescape(line[2:])...)
+	}
+
+	if !bytes.Equal(received, data) {
+		t.Errorf("data was not received intact")
 	}
 }
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrCardStub is returned when deleting a stub referencing a key stored on a
+// smart card without DeleteKeyOptions.StubOnly.
+var ErrCardStub = errors.New("github.com/cognitive-i/gpg/agent: key is a smart card stub, set StubOnly to delete it")
+
+// DeleteKeyOptions configures Delete.
+type DeleteKeyOptions struct {
+	// Force deletes the key without asking for confirmation.
+	Force bool
+
+	// StubOnly deletes the key only if it's a stub referencing a key stored
+	// on a smart card, gpg-agent refuses to delete any other key. Stubs
+	// aren't deleted without it.
+	StubOnly bool
+
+	// Confirm asks for confirmation instead of gpg-agent's pinentry, which
+	// can't be answered through a loopback pinentry. The key is only deleted
+	// if it returns true, otherwise Delete fails with ErrNotConfirmed.
+	Confirm func(ctx context.Context, key *Key) (bool, error)
+}
+
+// DeleteKey deletes the key with the specified keygrip from the key store of
+// gpg-agent.
+func (conn *Conn) DeleteKey(keygrip string, opts *DeleteKeyOptions) error {
+	return conn.DeleteKeyContext(context.Background(), keygrip, opts)
+}
+
+// DeleteKeyContext is like DeleteKey, but aborts the operation when ctx is
+// done.
+func (conn *Conn) DeleteKeyContext(ctx context.Context, keygrip string, opts *DeleteKeyOptions) error {
+	key, err := conn.KeyContext(ctx, keygrip)
+	if err != nil {
+		return err
+	}
+
+	return key.DeleteContext(ctx, opts)
+}
+
+// Delete deletes this key from the key store of gpg-agent. Unless opts
+// forces it or provides a Confirm function, gpg-agent asks the user to
+// confirm through pinentry.
+func (key *Key) Delete(opts *DeleteKeyOptions) error {
+	return key.DeleteContext(context.Background(), opts)
+}
+
+// DeleteContext is like Delete, but aborts the operation when ctx is done.
+func (key *Key) DeleteContext(ctx context.Context, opts *DeleteKeyOptions) error {
+	if opts == nil {
+		opts = &DeleteKeyOptions{}
+	}
+
+	if key.Type == StoredOnCard && !opts.StubOnly {
+		return ErrCardStub
+	}
+
+	force := opts.Force
+	if !force && opts.Confirm != nil {
+		ok, err := opts.Confirm(ctx, key)
+		if err != nil {
+			return err
+		} else if !ok {
+			return ErrNotConfirmed
+		}
+
+		force = true
+	}
+
+	cmd := []string{"DELETE_KEY"}
+	if force {
+		cmd = append(cmd, "--force")
+	}
+	if opts.StubOnly {
+		cmd = append(cmd, "--stub-only")
+	}
+
+	conn, release, err := key.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return conn.RawContext(ctx, nil, "%s %s", strings.Join(cmd, " "), key.Keygrip)
+}
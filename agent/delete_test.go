@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+func TestDeleteKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	// The fake agent has no pinentry to confirm with.
+	if err := key.Delete(nil); !errors.Is(err, ErrNoPinentry) {
+		t.Errorf("expected %v, but got %v", ErrNoPinentry, err)
+	}
+
+	if err := key.Delete(&DeleteKeyOptions{StubOnly: true}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected %v, but got %v", ErrForbidden, err)
+	}
+
+	var confirmed string
+	opts := &DeleteKeyOptions{
+		Confirm: func(ctx context.Context, key *Key) (bool, error) {
+			confirmed = key.Keygrip
+			return false, nil
+		},
+	}
+
+	if err := c.DeleteKey(key.Keygrip, opts); err != ErrNotConfirmed {
+		t.Errorf("expected %v, but got %v", ErrNotConfirmed, err)
+	}
+
+	if confirmed != key.Keygrip {
+		t.Errorf("expected confirmation for %s, but got %q", key.Keygrip, confirmed)
+	}
+
+	if _, err := c.Key(key.Keygrip); err != nil {
+		t.Fatalf("expected the key to be kept, but got %v", err)
+	}
+
+	opts.Confirm = func(ctx context.Context, key *Key) (bool, error) {
+		return true, nil
+	}
+
+	if err := c.DeleteKey(key.Keygrip, opts); err != nil {
+		t.Fatalf("DeleteKey(): %s", err)
+	}
+
+	if _, err := c.Key(key.Keygrip); !IsNoSecretKey(err) {
+		t.Errorf("expected the key to be deleted, but got %v", err)
+	}
+
+	if err := c.DeleteKey(key.Keygrip, &DeleteKeyOptions{Force: true}); !IsNoSecretKey(err) {
+		t.Errorf("expected a missing key, but got %v", err)
+	}
+}
+
+func TestDeleteKeyCardStub(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, SerialNo: "D2760001240103040006123456780000", CardID: "OPENPGP.1"})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	if err := c.DeleteKey(keygrip, &DeleteKeyOptions{Force: true}); err != ErrCardStub {
+		t.Errorf("expected %v, but got %v", ErrCardStub, err)
+	}
+
+	if err := c.DeleteKey(keygrip, &DeleteKeyOptions{StubOnly: true}); err != nil {
+		t.Fatalf("DeleteKey(): %s", err)
+	}
+
+	if _, err := c.Key(keygrip); !IsNoSecretKey(err) {
+		t.Errorf("expected the stub to be deleted, but got %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+// Package ephemeral launches throwaway gpg-agent instances on temporary GnuPG
+// home directories, for integration tests and sandboxed signing jobs.
+package ephemeral
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cognitive-i/gpg/agent"
+)
+
+// killTimeout is how long Close waits for the agent to exit.
+const killTimeout = 5 * time.Second
+
+// Options configures an ephemeral gpg-agent.
+type Options struct {
+	// Seed is a GnuPG home directory, such as testdata/gnupg, whose
+	// contents are copied into the temporary one.
+	Seed string
+
+	// Program is the gpg-agent executable. By default gpg-agent is looked
+	// up in the PATH.
+	Program string
+
+	// The following fields are written to gpg-agent.conf, replacing any
+	// copied from Seed.
+	DefaultCacheTTL       time.Duration
+	MaxCacheTTL           time.Duration
+	AllowPresetPassphrase bool
+	AllowLoopbackPinentry bool
+	DisableScdaemon       bool
+	PinentryProgram       string
+	ScdaemonProgram       string
+
+	// ExtraConfig lists additional lines for gpg-agent.conf.
+	ExtraConfig []string
+}
+
+// Agent is a gpg-agent serving a temporary GnuPG home directory.
+type Agent struct {
+	Homedir string
+
+	program string
+}
+
+// Start creates a temporary GnuPG home directory as described by opts and
+// launches a gpg-agent for it. The agent must be shut down with Close.
+func Start(ctx context.Context, opts Options) (*Agent, error) {
+	homedir, err := ioutil.TempDir("", "gnupg")
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Agent{Homedir: homedir, program: opts.Program}
+	if err := a.setup(ctx, opts); err != nil {
+		// The agent may have been launched before setting up failed. The
+		// error of setting up says more than any of cleaning up.
+		_ = a.kill()
+		_ = a.remove()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *Agent) setup(ctx context.Context, opts Options) error {
+	if err := os.Chmod(a.Homedir, 0700); err != nil {
+		return err
+	}
+
+	if opts.Seed != "" {
+		if err := copyDir(a.Homedir, opts.Seed); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(a.Homedir, "gpg-agent.conf"), []byte(opts.config()), 0600); err != nil {
+		return err
+	}
+
+	conn, err := agent.DialContext(ctx, "", nil, a.dialOptions(agent.WithAutostart())...)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// config renders the gpg-agent.conf described by opts.
+func (opts Options) config() string {
+	var lines []string
+	if opts.DefaultCacheTTL > 0 {
+		lines = append(lines, fmt.Sprintf("default-cache-ttl %d", int(opts.DefaultCacheTTL.Seconds())))
+	}
+	if opts.MaxCacheTTL > 0 {
+		lines = append(lines, fmt.Sprintf("max-cache-ttl %d", int(opts.MaxCacheTTL.Seconds())))
+	}
+	if opts.AllowPresetPassphrase {
+		lines = append(lines, "allow-preset-passphrase")
+	}
+	if opts.AllowLoopbackPinentry {
+		lines = append(lines, "allow-loopback-pinentry")
+	}
+	if opts.DisableScdaemon {
+		lines = append(lines, "disable-scdaemon")
+	}
+	if opts.PinentryProgram != "" {
+		lines = append(lines, "pinentry-program "+opts.PinentryProgram)
+	}
+	if opts.ScdaemonProgram != "" {
+		lines = append(lines, "scdaemon-program "+opts.ScdaemonProgram)
+	}
+	lines = append(lines, opts.ExtraConfig...)
+
+	return strings.Join(append(lines, ""), "\n")
+}
+
+func (a *Agent) dialOptions(opts ...agent.DialOption) []agent.DialOption {
+	opts = append(opts, agent.WithHomedir(a.Homedir))
+	if a.program != "" {
+		opts = append(opts, agent.WithAgentProgram(a.program))
+	}
+
+	return opts
+}
+
+// Dial connects to the agent. The parameters are the same as for agent.Dial,
+// except that the socket is always the one of this agent.
+func (a *Agent) Dial(options []string, opts ...agent.DialOption) (*agent.Conn, error) {
+	return a.DialContext(context.Background(), options, opts...)
+}
+
+// DialContext is like Dial, but gives up when ctx is done.
+func (a *Agent) DialContext(ctx context.Context, options []string, opts ...agent.DialOption) (*agent.Conn, error) {
+	return agent.DialContext(ctx, "", options, a.dialOptions(opts...)...)
+}
+
+// Close shuts the agent down, waits for it to exit and removes its home
+// directory. The home directory is removed even if the agent couldn't be
+// shut down, in which case that error is returned.
+func (a *Agent) Close() error {
+	killErr := a.kill()
+	if err := a.remove(); killErr == nil {
+		return err
+	}
+
+	return killErr
+}
+
+// kill shuts the agent down, if it is running, and waits until it has removed
+// its socket on exiting.
+func (a *Agent) kill() error {
+	socket, err := agent.SocketPath(a.Homedir, agent.SocketStandard)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(socket); os.IsNotExist(err) {
+		return nil
+	}
+
+	if conn, err := a.Dial(nil); err == nil {
+		err = conn.Raw(nil, "KILLAGENT")
+		_ = conn.Close()
+		if err != nil {
+			return fmt.Errorf("killing gpg-agent: %w", err)
+		}
+	} else {
+		// The agent may not get as far as greeting its clients, so leave
+		// it to gpgconf, which finds it through its socket.
+		out, err := exec.Command(a.gpgconf(), "--homedir", a.Homedir, "--kill", "gpg-agent").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("killing gpg-agent: %w: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+
+	for {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gpg-agent still running on %s after %s", socket, killTimeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// gpgconf returns the gpgconf executable installed along with the agent's
+// program, or else the one in the PATH.
+func (a *Agent) gpgconf() string {
+	if dir := filepath.Dir(a.program); a.program != "" && dir != "." {
+		return filepath.Join(dir, "gpgconf")
+	}
+
+	return "gpgconf"
+}
+
+// remove removes the home directory, and the socket directory of the agent.
+func (a *Agent) remove() error {
+	// The agent may have put its sockets outside of the home directory.
+	if socket, err := agent.SocketPath(a.Homedir, agent.SocketStandard); err == nil {
+		if dir := filepath.Dir(socket); dir != a.Homedir {
+			_ = os.Remove(dir)
+		}
+	}
+
+	return os.RemoveAll(a.Homedir)
+}
+
+// copyDir copies the regular files and directories in src to dst.
+func copyDir(dst, src string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0700)
+		case fi.Mode().IsRegular():
+			return copyFile(target, path, fi.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+func copyFile(dst, src string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,86 @@
+package ephemeral
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognitive-i/gpg/agent"
+)
+
+func TestStart(t *testing.T) {
+	if _, err := exec.LookPath("gpg-agent"); err != nil {
+		t.Skip("gpg-agent is not installed")
+	}
+
+	a, err := Start(context.Background(), Options{
+		Seed:                  filepath.Join("..", "..", "testdata", "gnupg"),
+		DefaultCacheTTL:       time.Minute,
+		AllowPresetPassphrase: true,
+		DisableScdaemon:       true,
+	})
+	if err != nil {
+		t.Fatalf("Start(): %s", err)
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(a.Homedir, "gpg-agent.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "default-cache-ttl 60\nallow-preset-passphrase\ndisable-scdaemon\n"; string(config) != expected {
+		t.Errorf("expected gpg-agent.conf %q, but got %q", expected, config)
+	}
+
+	conn, err := a.Dial(nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+
+	keys, err := conn.Keys()
+	if err != nil {
+		t.Fatalf("Keys(): %s", err)
+	}
+
+	if numKeys := len(keys); numKeys != 4 {
+		t.Errorf("expected the 4 keys of the seed, but got %d", numKeys)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	socket, err := agent.SocketPath(a.Homedir, agent.SocketStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kill waits for the agent to exit, which removes its socket.
+	if err := a.kill(); err != nil {
+		t.Fatalf("kill(): %s", err)
+	}
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", socket)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close(): %s", err)
+	}
+
+	if _, err := os.Stat(a.Homedir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", a.Homedir)
+	}
+}
+
+func TestStartWithoutAgent(t *testing.T) {
+	_, err := Start(context.Background(), Options{Program: "/nonexistent/gpg-agent"})
+	if err == nil || !strings.Contains(err.Error(), "/nonexistent/gpg-agent") {
+		t.Fatalf("expected an error starting a nonexistent agent, but got %v", err)
+	}
+}
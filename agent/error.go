@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -11,6 +13,116 @@ type Error struct {
 	Description string
 }
 
+// ErrorSource identifies the GnuPG component an error originates from.
+type ErrorSource int
+
+// These constants define the most common ErrorSource values.
+const (
+	SourceUnknown  ErrorSource = 0
+	SourceGcrypt   ErrorSource = 1
+	SourceGPG      ErrorSource = 2
+	SourceGPGSM    ErrorSource = 3
+	SourceGPGAgent ErrorSource = 4
+	SourcePinentry ErrorSource = 5
+	SourceSCD      ErrorSource = 6
+	SourceKeybox   ErrorSource = 8
+	SourceDirmngr  ErrorSource = 10
+	SourceAssuan   ErrorSource = 15
+)
+
+// ErrorCode is a libgpg-error code without its source. The codes defined
+// below can be used as the target of errors.Is to test an Error.
+type ErrorCode int
+
+// These constants define the ErrorCode values callers typically care about.
+const (
+	ErrBadSignature         ErrorCode = 8
+	ErrNoPublicKey          ErrorCode = 9
+	ErrBadPassphrase        ErrorCode = 11
+	ErrNoSecretKey          ErrorCode = 17
+	ErrWrongSecretKey       ErrorCode = 18
+	ErrNotFound             ErrorCode = 27
+	ErrSyntax               ErrorCode = 29
+	ErrUnusableSecretKey    ErrorCode = 54
+	ErrInvalidValue         ErrorCode = 55
+	ErrNoData               ErrorCode = 58
+	ErrNotSupported         ErrorCode = 60
+	ErrTimeout              ErrorCode = 62
+	ErrNotImplemented       ErrorCode = 69
+	ErrUnsupportedAlgorithm ErrorCode = 84
+	ErrNoPinentry           ErrorCode = 85
+	ErrPinentry             ErrorCode = 86
+	ErrBadPIN               ErrorCode = 87
+	ErrCanceled             ErrorCode = 99
+	ErrCard                 ErrorCode = 108
+	ErrCardRemoved          ErrorCode = 110
+	ErrCardNotPresent       ErrorCode = 112
+	ErrNotConfirmed         ErrorCode = 114
+	ErrPINBlocked           ErrorCode = 130
+	ErrDecryptFailed        ErrorCode = 152
+	ErrUnknownCommand       ErrorCode = 175
+	ErrNoPassphrase         ErrorCode = 177
+	ErrFullyCanceled        ErrorCode = 198
+	ErrForbidden            ErrorCode = 251
+	ErrAssuanCanceled       ErrorCode = 277
+	ErrEOF                  ErrorCode = 16383
+	ErrExists               ErrorCode = errSystemError | 35
+	ErrNoEntry              ErrorCode = errSystemError | 81
+)
+
+const (
+	// errSystemError flags error codes that wrap an errno value.
+	errSystemError = 1 << 15
+
+	errCodeMask    = 0xffff
+	errSourceMask  = 0x7f
+	errSourceShift = 24
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrBadSignature:         "bad signature",
+	ErrNoPublicKey:          "no public key",
+	ErrBadPassphrase:        "bad passphrase",
+	ErrNoSecretKey:          "no secret key",
+	ErrWrongSecretKey:       "wrong secret key used",
+	ErrNotFound:             "not found",
+	ErrSyntax:               "syntax error",
+	ErrUnusableSecretKey:    "unusable secret key",
+	ErrInvalidValue:         "invalid value",
+	ErrNoData:               "no data",
+	ErrNotSupported:         "not supported",
+	ErrTimeout:              "timeout",
+	ErrNotImplemented:       "not implemented",
+	ErrUnsupportedAlgorithm: "unsupported algorithm",
+	ErrNoPinentry:           "no pinentry",
+	ErrPinentry:             "pinentry error",
+	ErrBadPIN:               "bad PIN",
+	ErrCanceled:             "operation cancelled",
+	ErrCard:                 "general card error",
+	ErrCardRemoved:          "card removed",
+	ErrCardNotPresent:       "card not present",
+	ErrNotConfirmed:         "not confirmed",
+	ErrPINBlocked:           "PIN blocked",
+	ErrDecryptFailed:        "decryption failed",
+	ErrUnknownCommand:       "unknown command",
+	ErrNoPassphrase:         "no passphrase given",
+	ErrFullyCanceled:        "operation fully cancelled",
+	ErrForbidden:            "forbidden",
+	ErrAssuanCanceled:       "IPC call has been cancelled",
+	ErrEOF:                  "end of file",
+	ErrExists:               "file exists",
+	ErrNoEntry:              "no such file or directory",
+}
+
+// Error implements the error interface.
+func (c ErrorCode) Error() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("error code %d", int(c))
+}
+
 // NewError parses a gpg-agent error.
 func NewError(line string) Error {
 	part := strings.SplitN(line, " ", 3)
@@ -36,3 +148,72 @@ func NewError(line string) Error {
 func (e Error) Error() string {
 	return e.Description
 }
+
+// Source returns the GnuPG component the error originates from.
+func (e Error) Source() ErrorSource {
+	return ErrorSource((e.Code >> errSourceShift) & errSourceMask)
+}
+
+// ErrorCode returns the error code without its source.
+func (e Error) ErrorCode() ErrorCode {
+	return ErrorCode(e.Code & errCodeMask)
+}
+
+// Is reports whether the error matches target, which is either an ErrorCode
+// or an Error. This makes the error usable with errors.Is.
+func (e Error) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrorCode:
+		return e.ErrorCode() == t
+	case Error:
+		return e.Code == t.Code
+	}
+
+	return false
+}
+
+// isAny reports whether err matches any of the specified error codes.
+func isAny(err error, codes ...ErrorCode) bool {
+	for _, code := range codes {
+		if errors.Is(err, code) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsCanceled reports whether err means the user or the caller cancelled the
+// operation, e.g. by closing the pinentry.
+func IsCanceled(err error) bool {
+	return isAny(err, ErrCanceled, ErrFullyCanceled, ErrAssuanCanceled)
+}
+
+// IsNoSecretKey reports whether err means the requested key is not available
+// to gpg-agent.
+func IsNoSecretKey(err error) bool {
+	return isAny(err, ErrNoSecretKey, ErrNotFound, ErrNoEntry)
+}
+
+// IsBadPIN reports whether err means the passphrase or PIN entered was wrong.
+func IsBadPIN(err error) bool {
+	return isAny(err, ErrBadPIN, ErrBadPassphrase)
+}
+
+// IsCardMissing reports whether err means the smart card holding the key is
+// not inserted.
+func IsCardMissing(err error) bool {
+	return isAny(err, ErrCardRemoved, ErrCardNotPresent)
+}
+
+// IsNoPinentry reports whether err means gpg-agent was unable to ask for the
+// passphrase or PIN.
+func IsNoPinentry(err error) bool {
+	return isAny(err, ErrNoPinentry, ErrPinentry)
+}
+
+// IsTimeout reports whether err means the operation timed out within GnuPG,
+// for example because nobody answered the pinentry.
+func IsTimeout(err error) bool {
+	return isAny(err, ErrTimeout)
+}
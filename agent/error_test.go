@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNewError(t *testing.T) {
+	err := NewError("ERR 67108891 Not found <GPG Agent>")
+
+	if err.Code != 67108891 || err.Description != "Not found <GPG Agent>" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	if source := err.Source(); source != SourceGPGAgent {
+		t.Errorf("expected source %d, but got %d", SourceGPGAgent, source)
+	}
+
+	if code := err.ErrorCode(); code != ErrNotFound {
+		t.Errorf("expected code %d, but got %d", ErrNotFound, code)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	var err error = fmt.Errorf("signing: %w", NewError("ERR 83886179 Operation cancelled <Pinentry>"))
+
+	if !errors.Is(err, ErrCanceled) {
+		t.Errorf("expected %v to be %v", err, ErrCanceled)
+	}
+
+	if errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("expected %v not to be %v", err, ErrNoSecretKey)
+	}
+
+	if !errors.Is(err, Error{Code: 83886179}) {
+		t.Errorf("expected %v to be the same Error", err)
+	}
+
+	if !IsCanceled(err) || IsBadPIN(err) || IsNoSecretKey(err) {
+		t.Errorf("unexpected predicate results for %v", err)
+	}
+}
+
+func TestErrorIsWithAgent(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	_, err := c.Key("0000000000000000000000000000000000000000")
+	if !IsNoSecretKey(err) {
+		t.Errorf("expected %v to mean there is no secret key", err)
+	}
+
+	_, err = c.ReadKey("0000000000000000000000000000000000000000")
+	if !errors.Is(err, ErrNoEntry) {
+		t.Errorf("expected %v to be %v", err, ErrNoEntry)
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+
+	"github.com/cognitive-i/gpg/agent/internal/keywrap"
+)
+
+// ErrKeyOnCard is returned when exporting a key stored on a smart card,
+// which never hands out its private keys.
+var ErrKeyOnCard = errors.New("github.com/cognitive-i/gpg/agent: key is stored on a smart card and cannot be exported")
+
+// Export returns the private key of this key, either an *rsa.PrivateKey, an
+// ed25519.PrivateKey or an *ecdsa.PrivateKey. If the key is protected,
+// gpg-agent asks for its passphrase first.
+func (key *Key) Export() (crypto.PrivateKey, error) {
+	return key.ExportContext(context.Background())
+}
+
+// ExportContext is like Export, but aborts the operation when ctx is done.
+func (key *Key) ExportContext(ctx context.Context) (crypto.PrivateKey, error) {
+	data, err := key.export(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(data)
+
+	return decodePrivateKey(trimKey(data))
+}
+
+// ExportOpenPGP returns the private key of this key as the s-expression
+// gpg-agent uses to transfer keys in the RFC 4880 format, with the secret
+// parameters encrypted with the passphrase of the key. Unprotected keys
+// can't be exported this way.
+func (key *Key) ExportOpenPGP() ([]byte, error) {
+	return key.ExportOpenPGPContext(context.Background())
+}
+
+// ExportOpenPGPContext is like ExportOpenPGP, but aborts the operation when
+// ctx is done.
+func (key *Key) ExportOpenPGPContext(ctx context.Context) ([]byte, error) {
+	data, err := key.export(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return trimKey(data), nil
+}
+
+// export runs EXPORT_KEY and returns the unwrapped key.
+func (key *Key) export(ctx context.Context, openpgp bool) ([]byte, error) {
+	if key.Type == StoredOnCard {
+		return nil, ErrKeyOnCard
+	}
+
+	cmd := "EXPORT_KEY"
+	if openpgp {
+		cmd += " --openpgp"
+	}
+
+	conn, release, err := key.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var kek, wrapped []byte
+	err = conn.withPassphrase(ctx, key.passphraseRequest(), key.pinentry, func(inq inquiries) (err error) {
+		if kek, err = conn.RawDataContext(ctx, nil, "KEYWRAP_KEY --export"); err != nil {
+			return err
+		}
+
+		if err := conn.setKeyDesc(ctx, key.pinentry); err != nil {
+			return err
+		}
+
+		wrapped, err = conn.collect(ctx, nil, inq, "%s %s", cmd, key.Keygrip)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keywrap.Unwrap(kek, wrapped)
+}
+
+// trimKey strips the zero bytes padding an unwrapped s-expression.
+func trimKey(data []byte) []byte {
+	return bytes.TrimRight(data, "\x00")
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+	"github.com/cognitive-i/gpg/internal/brainpool"
+)
+
+func TestExport(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	privs := []crypto.PrivateKey{rsaKey, ed25519Key}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P521(), brainpool.P384r1()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey(%s): %s", curve.Params().Name, err)
+		}
+
+		privs = append(privs, priv)
+	}
+
+	for _, priv := range privs {
+		func() {
+			s, c, key := startFakeAgent(t, priv)
+			defer s.Close()
+			defer c.Close()
+
+			exported, err := key.Export()
+			if err != nil {
+				t.Errorf("%T: Export(): %s", priv, err)
+				return
+			}
+
+			if !equalPrivateKeys(priv, exported) {
+				t.Errorf("%T: exported key doesn't match, got %T", priv, exported)
+			}
+		}()
+	}
+}
+
+func equalPrivateKeys(a, b crypto.PrivateKey) bool {
+	switch a := a.(type) {
+	case *rsa.PrivateKey:
+		b, ok := b.(*rsa.PrivateKey)
+		return ok && a.N.Cmp(b.N) == 0 && a.E == b.E && a.D.Cmp(b.D) == 0
+	case ed25519.PrivateKey:
+		b, ok := b.(ed25519.PrivateKey)
+		return ok && bytes.Equal(a, b)
+	case *ecdsa.PrivateKey:
+		b, ok := b.(*ecdsa.PrivateKey)
+		return ok && a.Curve == b.Curve && a.D.Cmp(b.D) == 0 && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	}
+
+	return false
+}
+
+func TestExportWithPassphrase(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, Protected: true, Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, []string{"pinentry-mode=loopback"})
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	c.HandleInquiry(InquirePassphrase, InquiryData([]byte("wrong")))
+	if _, err := key.Export(); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("expected %v, but got %v", ErrBadPassphrase, err)
+	}
+
+	c.HandleInquiry(InquirePassphrase, InquiryData([]byte("secret")))
+	exported, err := key.Export()
+	if err != nil {
+		t.Fatalf("Export(): %s", err)
+	}
+
+	if !equalPrivateKeys(priv, exported) {
+		t.Errorf("exported key doesn't match")
+	}
+
+	data, err := key.ExportOpenPGP()
+	if err != nil {
+		t.Fatalf("ExportOpenPGP(): %s", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte("(19:openpgp-private-key")) {
+		t.Errorf("unexpected openpgp key %q", data)
+	}
+}
+
+func TestExportOpenPGPUnprotected(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	if _, err := key.ExportOpenPGP(); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("expected %v, but got %v", ErrNoPassphrase, err)
+	}
+}
+
+func TestExportKeyOnCard(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, SerialNo: "D2760001240103040006123456780000", CardID: "OPENPGP.1"})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if _, err := key.Export(); err != ErrKeyOnCard {
+		t.Errorf("expected %v, but got %v", ErrKeyOnCard, err)
+	}
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"time"
+
+	"github.com/cognitive-i/gpg"
+	"github.com/cognitive-i/gpg/agent/internal/keywrap"
+)
+
+// ImportKeyOptions configures ImportKey.
+type ImportKeyOptions struct {
+	// Passphrase protects the imported key. It's handed to gpg-agent through
+	// a loopback pinentry, so no pinentry is shown. If it's empty, the key
+	// is stored without protection.
+	Passphrase []byte
+
+	// Force overwrites a key with the same keygrip that's already stored by
+	// gpg-agent. Otherwise importing such a key fails.
+	Force bool
+
+	// Created is recorded as the creation time of the key. If it's zero,
+	// gpg-agent uses the current time.
+	Created time.Time
+}
+
+// ImportKey stores a private key in gpg-agent and returns its keygrip. The
+// private key is either an *rsa.PrivateKey, an ed25519.PrivateKey or an
+// *ecdsa.PrivateKey on a NIST or brainpool curve. Brainpool keys must use the
+// curves returned by gpg.BrainpoolP256r1 and its siblings.
+func (conn *Conn) ImportKey(priv crypto.PrivateKey, opts *ImportKeyOptions) (string, error) {
+	return conn.ImportKeyContext(context.Background(), priv, opts)
+}
+
+// ImportKeyContext is like ImportKey, but aborts the operation when ctx is
+// done.
+func (conn *Conn) ImportKeyContext(ctx context.Context, priv crypto.PrivateKey, opts *ImportKeyOptions) (string, error) {
+	if opts == nil {
+		opts = &ImportKeyOptions{}
+	}
+
+	keyData, err := encodePrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(keyData)
+
+	// All private keys supported by encodePrivateKey are crypto.Signers.
+	keygrip, err := gpg.ComputeKeygrip(priv.(crypto.Signer).Public())
+	if err != nil {
+		return "", err
+	}
+
+	cmd := []string{"IMPORT_KEY"}
+	if opts.Force {
+		cmd = append(cmd, "--force")
+	}
+	if !opts.Created.IsZero() {
+		cmd = append(cmd, "--timestamp="+opts.Created.UTC().Format("20060102T150405"))
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	// The key wrapping key is only valid for the session it came from.
+	end, err := conn.begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer end()
+
+	kek, err := conn.RawDataContext(ctx, nil, "KEYWRAP_KEY --import")
+	if err != nil {
+		return "", err
+	}
+
+	padded := padKey(keyData)
+	defer wipe(padded)
+
+	wrapped, err := keywrap.Wrap(kek, padded)
+	if err != nil {
+		return "", err
+	}
+
+	// gpg-agent asks for the passphrase protecting the key, which is
+	// answered through a loopback pinentry.
+	inq := inquiries{
+		InquireKeyData:       InquiryData(wrapped),
+		InquireNewPassphrase: InquiryData(opts.Passphrase),
+	}
+
+	err = conn.loopback(ctx, func() error {
+		return conn.transact(ctx, nil, inq, "%s", strings.Join(cmd, " "))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return keygrip, nil
+}
+
+// loopback runs f with the pinentry-mode of the session set to loopback, so
+// gpg-agent inquires passphrases from us. The caller must hold conn.mu.
+func (conn *Conn) loopback(ctx context.Context, f func() error) (err error) {
+	if err := conn.RawContext(ctx, nil, "OPTION pinentry-mode=loopback"); err != nil {
+		return err
+	}
+	defer func() {
+		if resetErr := conn.RawContext(ctx, nil, "OPTION pinentry-mode=%s", conn.pinentryMode()); err == nil {
+			err = resetErr
+		}
+	}()
+
+	return f()
+}
+
+// padKey pads a canonical s-expression with zero bytes to a length key wrap
+// accepts. gpg-agent ignores anything following the s-expression.
+func padKey(keyData []byte) []byte {
+	n := (len(keyData) + 7) / 8 * 8
+	if n < 16 {
+		n = 16
+	}
+
+	padded := make([]byte, n)
+	copy(padded, keyData)
+	return padded
+}
+
+// wipe overwrites b with zeros.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/cognitive-i/gpg"
+)
+
+func TestImportKey(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	privs := []crypto.Signer{rsaKey, ed25519Key}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), gpg.BrainpoolP256r1()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey(%s): %s", curve.Params().Name, err)
+		}
+
+		privs = append(privs, priv)
+	}
+
+	digest := sha256.Sum256([]byte("Hello World"))
+	for _, priv := range privs {
+		keygrip, err := c.ImportKey(priv, nil)
+		if err != nil {
+			t.Errorf("ImportKey(%T): %s", priv, err)
+			continue
+		}
+
+		if kg := gpg.Keygrip(priv.Public()); kg != keygrip {
+			t.Errorf("%T: expected keygrip %s, but got %s", priv, kg, keygrip)
+		}
+
+		key, err := c.Key(keygrip)
+		if err != nil {
+			t.Errorf("Key(%s): %s", keygrip, err)
+			continue
+		}
+
+		if key.Protection != ProtByNothing {
+			t.Errorf("%T: expected an unprotected key, but got %+v", priv, key)
+		}
+
+		var opts crypto.SignerOpts = crypto.SHA256
+		if _, ok := priv.(ed25519.PrivateKey); ok {
+			opts = crypto.Hash(0)
+		}
+
+		sig, err := key.Sign(rand.Reader, digest[:], opts)
+		if err != nil {
+			t.Errorf("%T: Sign(): %s", priv, err)
+			continue
+		}
+
+		switch pub := priv.Public().(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+		case ed25519.PublicKey:
+			if !ed25519.Verify(pub, digest[:], sig) {
+				err = errors.New("invalid signature")
+			}
+		case *ecdsa.PublicKey:
+			err = verifyECDSA(pub, digest[:], sig)
+		}
+		if err != nil {
+			t.Errorf("%T: %s", priv, err)
+		}
+	}
+}
+
+func TestImportKeyWithPassphrase(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := c.ImportKey(priv, &ImportKeyOptions{Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatalf("ImportKey(): %s", err)
+	}
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if key.Protection != ProtByPassphrase {
+		t.Errorf("expected a protected key, but got %+v", key)
+	}
+
+	if _, err := c.ImportKey(priv, nil); !errors.Is(err, ErrExists) {
+		t.Errorf("expected %v, but got %v", ErrExists, err)
+	}
+
+	if _, err := c.ImportKey(priv, &ImportKeyOptions{Force: true}); err != nil {
+		t.Errorf("ImportKey() with Force: %s", err)
+	}
+
+	if key, err = c.Key(keygrip); err != nil {
+		t.Errorf("Key(%s): %s", keygrip, err)
+	} else if key.Protection != ProtByNothing {
+		t.Errorf("expected the key to be replaced, but got %+v", key)
+	}
+}
+
+func TestImportKeyUnsupported(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	if _, err := c.ImportKey(struct{}{}, nil); err == nil {
+		t.Errorf("expected an error")
+	}
+}
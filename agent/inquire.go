@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// These constants define the keywords gpg-agent uses in its inquiries.
+const (
+	InquirePassphrase       = "PASSPHRASE"
+	InquireNewPassphrase    = "NEW_PASSPHRASE"
+	InquireNewPasswd        = "NEWPASSWD"
+	InquireNeedPIN          = "NEEDPIN"
+	InquireKeyParam         = "KEYPARAM"
+	InquireCipherText       = "CIPHERTEXT"
+	InquirePinentryLaunched = "PINENTRY_LAUNCHED"
+	InquireKeyData          = "KEYDATA"
+	InquireTBSData          = "TBSDATA"
+)
+
+// Inquiry describes an INQUIRE sent by gpg-agent in the middle of a command.
+type Inquiry struct {
+	Keyword string
+	Params  string
+}
+
+// InquiryFunc answers an inquiry. Everything written to w is sent to
+// gpg-agent as data. When the function returns nil the inquiry is completed,
+// otherwise it is cancelled and the command fails with the returned error.
+//
+// The function is called while the connection is busy with the command that
+// triggered the inquiry, so it must not use the connection itself.
+type InquiryFunc func(ctx context.Context, inq Inquiry, w io.Writer) error
+
+// inquiries maps inquiry keywords to the functions answering them.
+type inquiries map[string]InquiryFunc
+
+// PinentryLaunched describes the pinentry started by gpg-agent, as reported
+// by the PINENTRY_LAUNCHED inquiry.
+type PinentryLaunched struct {
+	PID     int
+	Flavor  string
+	Version string
+	TTY     string
+	Display string
+}
+
+func parseInquiry(line string) Inquiry {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+
+	inq := Inquiry{Keyword: parts[0]}
+	if len(parts) == 2 {
+		inq.Params = strings.TrimSpace(parts[1])
+	}
+
+	return inq
+}
+
+// Prompt returns the prompt sent along with a PASSPHRASE, NEW_PASSPHRASE or
+// NEEDPIN inquiry.
+func (inq Inquiry) Prompt() string {
+	return decode(inq.Params)
+}
+
+// PinentryLaunched parses the parameters of a PINENTRY_LAUNCHED inquiry.
+func (inq Inquiry) PinentryLaunched() (PinentryLaunched, error) {
+	if inq.Keyword != InquirePinentryLaunched {
+		return PinentryLaunched{}, fmt.Errorf("%s: not a %s inquiry", inq.Keyword, InquirePinentryLaunched)
+	}
+
+	parts := strings.Fields(inq.Params)
+	if len(parts) == 0 {
+		return PinentryLaunched{}, fmt.Errorf(errIllegalFormat, inq.Keyword)
+	}
+
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PinentryLaunched{}, err
+	}
+
+	info := PinentryLaunched{PID: pid}
+	for i, part := range parts[1:] {
+		if part == "-" {
+			continue
+		}
+
+		switch i {
+		case 0:
+			info.Flavor = part
+		case 1:
+			info.Version = part
+		case 2:
+			info.TTY = part
+		case 3:
+			info.Display = part
+		}
+	}
+
+	return info, nil
+}
+
+// InquiryData returns an InquiryFunc that always answers with data.
+func InquiryData(data []byte) InquiryFunc {
+	return func(ctx context.Context, inq Inquiry, w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
+
+// HandleInquiry registers f to answer inquiries with the specified keyword
+// on this connection. A nil f removes the handler again. Inquiries without
+// a handler are answered with no data at all.
+func (conn *Conn) HandleInquiry(keyword string, f InquiryFunc) {
+	conn.inquiryMu.Lock()
+	defer conn.inquiryMu.Unlock()
+
+	if f == nil {
+		delete(conn.inquiries, keyword)
+		return
+	}
+
+	if conn.inquiries == nil {
+		conn.inquiries = inquiries{}
+	}
+	conn.inquiries[keyword] = f
+}
+
+// handler returns the function answering inquiries with keyword, preferring
+// the ones specific to the current command over the registered ones.
+func (conn *Conn) handler(keyword string, inq inquiries) InquiryFunc {
+	if f, ok := inq[keyword]; ok {
+		return f
+	}
+
+	conn.inquiryMu.RLock()
+	defer conn.inquiryMu.RUnlock()
+
+	return conn.inquiries[keyword]
+}
+
+// inquire answers inq and terminates the data with END. Any error returned
+// leaves the inquiry pending, so the caller has to cancel it.
+func (conn *Conn) inquire(ctx context.Context, inq Inquiry, handlers inquiries) error {
+	w := &dataWriter{conn: conn}
+	if f := conn.handler(inq.Keyword, handlers); f != nil {
+		if err := f(ctx, inq, w); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
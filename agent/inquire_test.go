@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// echoInquiry answers any command with an inquiry for keyword and sends the
+// data it received back, or fails the command when the inquiry is cancelled.
+func echoInquiry(keyword string) func(r *bufio.Reader, w io.Writer) {
+	return func(r *bufio.Reader, w io.Writer) {
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+
+			_, _ = io.WriteString(w, "INQUIRE "+keyword+" some params\n")
+
+			var data []string
+		inquiry:
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				switch line = strings.TrimSpace(line); {
+				case line == "END":
+					if len(data) > 0 {
+						_, _ = io.WriteString(w, "D "+strings.Join(data, "")+"\n")
+					}
+					_, _ = io.WriteString(w, "OK\n")
+					break inquiry
+				case line == "CAN":
+					_, _ = io.WriteString(w, "ERR 99 Operation cancelled\n")
+					break inquiry
+				case strings.HasPrefix(line, "D "):
+					data = append(data, line[2:])
+				}
+			}
+		}
+	}
+}
+
+func TestHandleInquiry(t *testing.T) {
+	scripted := dialScripted(t, echoInquiry(InquireKeyParam))
+	defer scripted.Close()
+
+	var got Inquiry
+	scripted.HandleInquiry(InquireKeyParam, func(ctx context.Context, inq Inquiry, w io.Writer) error {
+		got = inq
+		_, err := io.WriteString(w, "(genkey(rsa(nbits 4:2048)))")
+		return err
+	})
+
+	var response string
+	err := scripted.Raw(func(respType, data string) error {
+		if respType == "D" {
+			response = data
+		}
+		return nil
+	}, "GENKEY")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got.Keyword != InquireKeyParam || got.Params != "some params" {
+		t.Errorf("unexpected inquiry %+v", got)
+	}
+
+	if expected := "(genkey(rsa(nbits 4:2048)))"; response != expected {
+		t.Errorf("expected %q to be sent, but got %q", expected, response)
+	}
+
+	// Without a handler the inquiry is passed on and answered with no
+	// data.
+	scripted.HandleInquiry(InquireKeyParam, nil)
+	response = ""
+	var inquiry string
+	err = scripted.Raw(func(respType, data string) error {
+		switch respType {
+		case "D":
+			response = data
+		case "INQUIRE":
+			inquiry = data
+		}
+		return nil
+	}, "GENKEY")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := InquireKeyParam + " some params"; inquiry != expected {
+		t.Errorf("expected inquiry %q to be passed on, but got %q", expected, inquiry)
+	}
+
+	if response != "" {
+		t.Errorf("expected no data to be sent, but got %q", response)
+	}
+}
+
+func TestUnhandledInquiryError(t *testing.T) {
+	scripted := dialScripted(t, echoInquiry(InquireKeyParam))
+	defer scripted.Close()
+
+	errRefused := errors.New("refused")
+	err := scripted.Raw(func(respType, data string) error {
+		if respType == "INQUIRE" {
+			return errRefused
+		}
+		return nil
+	}, "GENKEY")
+	if err != errRefused {
+		t.Fatalf("expected %v, but got %v", errRefused, err)
+	}
+
+	// The cancelled inquiry must leave the connection in a usable state.
+	if err := scripted.Raw(nil, "GENKEY"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestHandleInquiryError(t *testing.T) {
+	scripted := dialScripted(t, echoInquiry(InquirePassphrase))
+	defer scripted.Close()
+
+	errNoPassphrase := errors.New("no passphrase")
+	scripted.HandleInquiry(InquirePassphrase, func(ctx context.Context, inq Inquiry, w io.Writer) error {
+		return errNoPassphrase
+	})
+
+	if err := scripted.Raw(nil, "PKSIGN"); err != errNoPassphrase {
+		t.Fatalf("expected %v, but got %v", errNoPassphrase, err)
+	}
+
+	// The cancelled inquiry must leave the connection in a usable state.
+	scripted.HandleInquiry(InquirePassphrase, InquiryData([]byte("secret")))
+	if err := scripted.Raw(nil, "PKSIGN"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestInquiryPinentryLaunched(t *testing.T) {
+	inq := parseInquiry("PINENTRY_LAUNCHED 4242 curses 1.1.0 /dev/pts/3 -")
+
+	info, err := inq.PinentryLaunched()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := PinentryLaunched{PID: 4242, Flavor: "curses", Version: "1.1.0", TTY: "/dev/pts/3"}
+	if info != expected {
+		t.Errorf("expected %+v, but got %+v", expected, info)
+	}
+
+	if _, err := parseInquiry("KEYPARAM").PinentryLaunched(); err == nil {
+		t.Error("expected an error parsing a KEYPARAM inquiry")
+	}
+}
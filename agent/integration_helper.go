@@ -34,6 +34,11 @@ func connectClientToAgent(listener net.Listener) {
 	}
 }
 
+// StartGpgAgent serves a single connection with a gpg-agent running on the
+// testdata keyring and returns the socket to dial for it.
+//
+// Deprecated: Use the ephemeral package, which supports any number of
+// connections and isolates the agent from the keyring it was seeded with.
 func StartGpgAgent() (socketFilename string, err error) {
 	var listener net.Listener
 	listener, err = net.Listen("unix", "")
@@ -0,0 +1,89 @@
+// Package keywrap implements the AES key wrap algorithm of RFC 3394, which
+// gpg-agent uses to protect keys passed through IMPORT_KEY and EXPORT_KEY.
+package keywrap
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrInvalidLength is returned for input that isn't a multiple of 8 bytes
+// or is too short to be wrapped.
+var ErrInvalidLength = errors.New("keywrap: invalid input length")
+
+// ErrIntegrity is returned by Unwrap when the integrity check fails, which
+// usually means the wrong key was used.
+var ErrIntegrity = errors.New("keywrap: integrity check failed")
+
+// defaultIV is the initial value of RFC 3394, section 2.2.3.1.
+var defaultIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// Wrap wraps plaintext, which must be a multiple of 8 bytes and at least 16
+// bytes long, with the AES key kek.
+func Wrap(kek, plaintext []byte) ([]byte, error) {
+	if len(plaintext)%8 != 0 || len(plaintext) < 16 {
+		return nil, ErrInvalidLength
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(plaintext) / 8
+	out := make([]byte, 8+len(plaintext))
+	copy(out, defaultIV)
+	copy(out[8:], plaintext)
+
+	var b [aes.BlockSize]byte
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b[:], b[:])
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[8*i:8*i+8], b[8:])
+		}
+	}
+
+	return out, nil
+}
+
+// Unwrap reverses Wrap, checking the integrity of ciphertext.
+func Unwrap(kek, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext)%8 != 0 || len(ciphertext) < 24 {
+		return nil, ErrInvalidLength
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(ciphertext)/8 - 1
+	out := make([]byte, len(ciphertext))
+	copy(out, ciphertext)
+
+	var b [aes.BlockSize]byte
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^t)
+			copy(b[8:], out[8*i:8*i+8])
+			block.Decrypt(b[:], b[:])
+
+			copy(out[:8], b[:8])
+			copy(out[8*i:8*i+8], b[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(out[:8], defaultIV) != 1 {
+		return nil, ErrIntegrity
+	}
+
+	return out[8:], nil
+}
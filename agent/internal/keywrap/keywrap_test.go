@@ -0,0 +1,80 @@
+package keywrap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// TestWrap uses the test vectors of RFC 3394, section 4.
+func TestWrap(t *testing.T) {
+	vectors := []struct {
+		kek, plaintext, ciphertext string
+	}{
+		{
+			"000102030405060708090A0B0C0D0E0F",
+			"00112233445566778899AABBCCDDEEFF",
+			"1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F1011121314151617",
+			"00112233445566778899AABBCCDDEEFF",
+			"96778B25AE6CA435F92B5B97C050AED2468AB8A17AD84E5D",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF0001020304050607",
+			"A8F9BC1612C68B3FF6E6F4FBE30E71E4769C8B80A32CB8958CD5D17D6B254DA1",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			"28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+
+	for _, v := range vectors {
+		kek, plaintext, ciphertext := mustDecode(v.kek), mustDecode(v.plaintext), mustDecode(v.ciphertext)
+
+		wrapped, err := Wrap(kek, plaintext)
+		if err != nil {
+			t.Errorf("Wrap(%s): %s", v.plaintext, err)
+		} else if !bytes.Equal(wrapped, ciphertext) {
+			t.Errorf("Wrap(%s): expected %s, but got %x", v.plaintext, v.ciphertext, wrapped)
+		}
+
+		unwrapped, err := Unwrap(kek, ciphertext)
+		if err != nil {
+			t.Errorf("Unwrap(%s): %s", v.ciphertext, err)
+		} else if !bytes.Equal(unwrapped, plaintext) {
+			t.Errorf("Unwrap(%s): expected %s, but got %x", v.ciphertext, v.plaintext, unwrapped)
+		}
+	}
+}
+
+func TestUnwrapErrors(t *testing.T) {
+	kek := mustDecode("000102030405060708090A0B0C0D0E0F")
+	ciphertext := mustDecode("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err := Unwrap(kek, ciphertext); err != ErrIntegrity {
+		t.Errorf("expected %v, but got %v", ErrIntegrity, err)
+	}
+
+	if _, err := Unwrap(kek, ciphertext[:20]); err != ErrInvalidLength {
+		t.Errorf("expected %v, but got %v", ErrInvalidLength, err)
+	}
+
+	if _, err := Wrap(kek, ciphertext[:8]); err != ErrInvalidLength {
+		t.Errorf("expected %v, but got %v", ErrInvalidLength, err)
+	}
+}
@@ -0,0 +1,94 @@
+// Package x25519 implements the X25519 function of RFC 7748, for tests that
+// need to check ECDH results computed by gpg-agent.
+//
+// The implementation is neither fast nor constant time, so it must not be
+// used with secret scalars outside of tests.
+package x25519
+
+import "math/big"
+
+// Size is the length of X25519 scalars and points.
+const Size = 32
+
+// Basepoint is the u-coordinate of the base point of Curve25519.
+var Basepoint = []byte{9, 31: 0}
+
+var (
+	p   = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	a24 = big.NewInt(121665)
+)
+
+// X25519 multiplies the point with the u-coordinate point by scalar. Both
+// are encoded as in RFC 7748.
+func X25519(scalar, point []byte) []byte {
+	k := make([]byte, Size)
+	copy(k, scalar)
+	k[0] &= 248
+	k[31] &= 127
+	k[31] |= 64
+
+	u := make([]byte, Size)
+	copy(u, point)
+	u[31] &= 127
+
+	x1 := decode(u)
+	x2, z2 := big.NewInt(1), big.NewInt(0)
+	x3, z3 := new(big.Int).Set(x1), big.NewInt(1)
+
+	swap := uint(0)
+	for t := 254; t >= 0; t-- {
+		kt := uint(k[t/8]>>uint(t%8)) & 1
+		if swap^kt == 1 {
+			x2, x3 = x3, x2
+			z2, z3 = z3, z2
+		}
+		swap = kt
+
+		a := mod(new(big.Int).Add(x2, z2))
+		aa := mod(new(big.Int).Mul(a, a))
+		b := mod(new(big.Int).Sub(x2, z2))
+		bb := mod(new(big.Int).Mul(b, b))
+		e := mod(new(big.Int).Sub(aa, bb))
+		c := mod(new(big.Int).Add(x3, z3))
+		d := mod(new(big.Int).Sub(x3, z3))
+		da := mod(new(big.Int).Mul(d, a))
+		cb := mod(new(big.Int).Mul(c, b))
+
+		x3 = mod(new(big.Int).Exp(new(big.Int).Add(da, cb), big.NewInt(2), p))
+		z3 = new(big.Int).Sub(da, cb)
+		z3 = mod(z3.Mul(x1, z3.Mul(z3, z3)))
+		x2 = mod(new(big.Int).Mul(aa, bb))
+		z2 = mod(new(big.Int).Mul(e, new(big.Int).Add(aa, new(big.Int).Mul(a24, e))))
+	}
+
+	if swap == 1 {
+		x2, z2 = x3, z3
+	}
+
+	return encode(mod(x2.Mul(x2, z2.ModInverse(z2, p))))
+}
+
+func mod(v *big.Int) *big.Int {
+	return v.Mod(v, p)
+}
+
+// decode decodes a little-endian number.
+func decode(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i, c := range b {
+		be[len(b)-1-i] = c
+	}
+
+	return mod(new(big.Int).SetBytes(be))
+}
+
+// encode encodes v as a little-endian number of Size bytes.
+func encode(v *big.Int) []byte {
+	be := v.Bytes()
+	b := make([]byte, Size)
+	for i, c := range be {
+		b[len(be)-1-i] = c
+	}
+
+	return b
+}
@@ -2,7 +2,11 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/hex"
 	"errors"
@@ -10,6 +14,7 @@ import (
 	"io"
 	"math/big"
 
+	"github.com/cognitive-i/gpg"
 	internalrsa "github.com/cognitive-i/gpg/agent/internal/rsa"
 )
 
@@ -34,6 +39,13 @@ const (
 	ProtUnknown
 )
 
+// X25519PublicKey is a Curve25519 public key used for ECDH, such as a cv25519
+// OpenPGP encryption key. It holds the u-coordinate encoded as in RFC 7748.
+type X25519PublicKey = gpg.X25519PublicKey
+
+// x25519Size is the length of X25519 public keys and shared secrets.
+const x25519Size = 32
+
 // Key describes the information gpg-agent exposes about a key.
 type Key struct {
 	Keygrip     string
@@ -46,7 +58,9 @@ type Key struct {
 	TimeToLive  string
 
 	conn      *Conn
+	pool      *Pool
 	publicKey crypto.PublicKey
+	pinentry  *PinentryOptions
 }
 
 // Public returns this key's public key.
@@ -60,13 +74,20 @@ func (key *Key) Public() crypto.PublicKey {
 //
 // This function is basically a copy of rsa.Decrypt().
 func (key *Key) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) (plaintext []byte, err error) {
+	return key.DecryptContext(context.Background(), rand, ciphertext, opts)
+}
+
+// DecryptContext is like Decrypt, but aborts the operation when ctx is done.
+func (key *Key) DecryptContext(ctx context.Context, rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) (plaintext []byte, err error) {
 	switch pub := key.publicKey.(type) {
 	case *rsa.PublicKey:
 		priv := &internalrsa.PrivateKey{
 			PrivateKey: rsa.PrivateKey{
 				PublicKey: *pub,
 			},
-			DecryptFunc: key.decrypt,
+			DecryptFunc: func(c *big.Int) (*big.Int, error) {
+				return key.decrypt(ctx, c)
+			},
 		}
 
 		if opts == nil {
@@ -107,96 +128,223 @@ func pubSize(pub *rsa.PublicKey) int {
 
 // Sign signs msg with this key, possibly using entropy from rand. If opts is
 // a *PSSOptions then the PSS algorithm will be used, otherwise PKCS#1 v1.5
-// will be used.
+// will be used. ECDSA keys sign msg as a digest, like ecdsa.PrivateKey; opts
+// may be nil then, and digests of unknown hash are signed as the hash of
+// their length, without that hash having to be linked in.
 //
 // This function is basically a copy of rsa.Sign().
 func (key *Key) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) (signature []byte, err error) {
+	return key.SignContext(context.Background(), rand, msg, opts)
+}
+
+// SignContext is like Sign, but aborts the operation when ctx is done.
+func (key *Key) SignContext(ctx context.Context, rand io.Reader, msg []byte, opts crypto.SignerOpts) (signature []byte, err error) {
+	if pub, ok := key.publicKey.(*rsa.PublicKey); ok {
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			priv := &internalrsa.PrivateKey{
+				PrivateKey: rsa.PrivateKey{
+					PublicKey: *pub,
+				},
+				DecryptFunc: func(c *big.Int) (*big.Int, error) {
+					return key.decrypt(ctx, c)
+				},
+			}
+
+			return internalrsa.SignPSS(rand, priv, pssOpts.Hash, msg, pssOpts)
+		}
+	}
+
+	op, err := key.signOp(msg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.sign(ctx, op)
+}
+
+// signOp is a message prepared for PKSIGN with a particular key.
+type signOp struct {
+	// hashType and digest are sent with SETHASH. If hashType is "", digest
+	// is the message itself, as signed by EdDSA.
+	hashType string
+	digest   []byte
+
+	// decode turns the signature s-expression into the signature format
+	// of the key.
+	decode func(sig []byte) ([]byte, error)
+}
+
+// signOp prepares signing msg with this key, as described by opts. RSA PSS
+// signatures can't be made with PKSIGN and are handled by SignContext.
+func (key *Key) signOp(msg []byte, opts crypto.SignerOpts) (signOp, error) {
 	switch pub := key.publicKey.(type) {
 	case *rsa.PublicKey:
-		priv := &internalrsa.PrivateKey{
-			PrivateKey: rsa.PrivateKey{
-				PublicKey: *pub,
-			},
-			DecryptFunc: key.decrypt,
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return signOp{}, errors.New("github.com/cognitive-i/gpg/agent: PSS signatures can't be made with PKSIGN")
 		}
 
-		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
-			return internalrsa.SignPSS(rand, priv, pssOpts.Hash, msg, pssOpts)
+		var h crypto.Hash
+		if opts != nil {
+			h = opts.HashFunc()
 		}
 
-		sig, err := key.signPKCS1v15(msg, opts.HashFunc())
+		hashType, err := hashType(h)
 		if err != nil {
-			return nil, err
+			return signOp{}, err
 		}
 
-		if diff := len(sig) - pubSize(pub); diff > 0 {
-			// It seems sometimes the signature can have leading zero bytes such that its over the keysize
-			leadingZeros := bytes.Repeat([]byte{00}, diff)
-			if !bytes.HasPrefix(sig, leadingZeros) {
-				return nil, errors.New("github.com/cognitive-i/gpg/agent: signature length too large with nonzero leading bytes")
-			}
-			// We trim the leading zeros
-			sig = bytes.TrimPrefix(sig, leadingZeros)
+		return signOp{
+			hashType: hashType,
+			digest:   msg,
+			decode: func(response []byte) ([]byte, error) {
+				return decodePKCS1v15Signature(pub, response)
+			},
+		}, nil
+
+	case *ecdsa.PublicKey:
+		return ecdsaSignOp(pub, msg, opts)
+
+	case ed25519.PublicKey:
+		if opts != nil && opts.HashFunc() != crypto.Hash(0) {
+			return signOp{}, errors.New("github.com/cognitive-i/gpg/agent: ed25519 cannot sign hashed messages")
 		}
 
-		return sig, nil
+		return signOp{digest: msg, decode: decodeEdDSASignature}, nil
+
 	default:
-		return nil, errors.New("github.com/cognitive-i/gpg/agent: unknown public key")
+		return signOp{}, errors.New("github.com/cognitive-i/gpg/agent: unknown public key")
 	}
 }
 
-func (key *Key) decrypt(c *big.Int) (*big.Int, error) {
+func (key *Key) decrypt(ctx context.Context, c *big.Int) (*big.Int, error) {
 	encCipherText, err := encodeRSACipherText(c.Bytes())
 	if err != nil {
 		return nil, err
 	}
 
-	key.conn.mu.Lock()
-	defer key.conn.mu.Unlock()
-
-	if err = key.conn.Raw(nil, "RESET"); err != nil {
+	plaintext, err := key.pkdecrypt(ctx, encCipherText)
+	if err != nil {
 		return nil, err
 	}
 
-	if err = key.conn.Raw(nil, "HAVEKEY %s", key.Keygrip); err != nil {
+	return (&big.Int{}).SetBytes(plaintext), nil
+}
+
+// pkdecrypt has gpg-agent decrypt the encoded ciphertext and returns the
+// plaintext value.
+func (key *Key) pkdecrypt(ctx context.Context, encCipherText []byte) ([]byte, error) {
+	conn, release, err := key.acquire(ctx)
+	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	var response []byte
+	err = conn.withPassphrase(ctx, key.passphraseRequest(), key.pinentry, func(inq inquiries) error {
+		if err := conn.RawContext(ctx, nil, "RESET"); err != nil {
+			return err
+		}
+
+		if err := conn.RawContext(ctx, nil, "HAVEKEY %s", key.Keygrip); err != nil {
+			return err
+		}
+
+		if err := conn.RawContext(ctx, nil, "SETKEY %s", key.Keygrip); err != nil {
+			return err
+		}
+
+		if err := conn.setKeyDesc(ctx, key.pinentry); err != nil {
+			return err
+		}
+
+		inq[InquireCipherText] = InquiryData(encCipherText)
 
-	if err = key.conn.Raw(nil, "SETKEY %s", key.Keygrip); err != nil {
+		var err error
+		response, err = conn.collect(ctx, nil, inq, "PKDECRYPT")
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	var response string
-	respFunc := func(respType, data string) error {
-		switch respType {
-		case "INQUIRE":
+	return decodePlainText(response)
+}
 
-			if err = key.conn.request("D %s\nEND\n", encode(string(encCipherText))); err != nil {
-				return err
-			}
+// ECDH performs the key agreement of this key with the ephemeral public key
+// of the other party and returns the shared secret.
+//
+// For Curve25519 keys, ephemeral and the shared secret are u-coordinates
+// encoded as in RFC 7748, optionally prefixed by 0x40 as in OpenPGP. For
+// keys on other curves, ephemeral is an uncompressed point and the shared
+// secret is its x-coordinate, as in RFC 6637.
+func (key *Key) ECDH(ephemeral []byte) ([]byte, error) {
+	return key.ECDHContext(context.Background(), ephemeral)
+}
 
-		case "D":
-			response = data
+// ECDHContext is like ECDH, but aborts the operation when ctx is done.
+func (key *Key) ECDHContext(ctx context.Context, ephemeral []byte) ([]byte, error) {
+	switch pub := key.publicKey.(type) {
+	case X25519PublicKey:
+		if len(ephemeral) == x25519Size+1 && ephemeral[0] == 0x40 {
+			ephemeral = ephemeral[1:]
+		}
+		if len(ephemeral) != x25519Size {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: invalid ephemeral public key")
 		}
 
-		return nil
-	}
+		shared, err := key.ecdh(ctx, append([]byte{0x40}, ephemeral...))
+		if err != nil {
+			return nil, err
+		}
 
-	if err = key.conn.Raw(respFunc, "PKDECRYPT"); err != nil {
-		return nil, err
+		if len(shared) == x25519Size+1 && shared[0] == 0x40 {
+			shared = shared[1:]
+		}
+		if len(shared) != x25519Size {
+			return nil, ErrUnknownFormat
+		}
+
+		return shared, nil
+
+	case *ecdsa.PublicKey:
+		if x, _ := elliptic.Unmarshal(pub.Curve, ephemeral); x == nil {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: invalid ephemeral public key")
+		}
+
+		shared, err := key.ecdh(ctx, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		x, _ := elliptic.Unmarshal(pub.Curve, shared)
+		if x == nil {
+			return nil, ErrUnknownFormat
+		}
+
+		secret := make([]byte, (pub.Curve.Params().BitSize+7)/8)
+		b := x.Bytes()
+		copy(secret[len(secret)-len(b):], b)
+
+		return secret, nil
+
+	default:
+		return nil, errors.New("github.com/cognitive-i/gpg/agent: unknown public key")
 	}
+}
 
-	plaintext, err := decodePlainText([]byte(response))
+func (key *Key) ecdh(ctx context.Context, ephemeral []byte) ([]byte, error) {
+	encCipherText, err := encodeECDHCipherText(ephemeral)
 	if err != nil {
 		return nil, err
 	}
 
-	return (&big.Int{}).SetBytes(plaintext), nil
+	return key.pkdecrypt(ctx, encCipherText)
 }
 
-func (key *Key) signPKCS1v15(msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+// hashType returns the name gpg-agent uses for the hash h.
+func hashType(h crypto.Hash) (string, error) {
 	var hashType string
-	switch opts.HashFunc() {
+	switch h {
 	case crypto.MD5:
 		hashType = "md5"
 	case crypto.RIPEMD160:
@@ -214,46 +362,174 @@ func (key *Key) signPKCS1v15(msg []byte, opts crypto.SignerOpts) ([]byte, error)
 	case crypto.MD5SHA1:
 		hashType = "tls-md5sha1"
 	default:
-		return nil, fmt.Errorf("%v: unknown hash type", opts.HashFunc())
+		return "", fmt.Errorf("%v: unknown hash type", h)
 	}
 
-	if !opts.HashFunc().Available() {
-		return nil, fmt.Errorf("%s: hash type is not available", hashType)
+	if !h.Available() {
+		return "", fmt.Errorf("%s: hash type is not available", hashType)
 	}
 
-	key.conn.mu.Lock()
-	defer key.conn.mu.Unlock()
+	return hashType, nil
+}
 
-	if err := key.conn.Raw(nil, "RESET"); err != nil {
+// decodePKCS1v15Signature decodes the RSA signature response of gpg-agent
+// for the key pub.
+func decodePKCS1v15Signature(pub *rsa.PublicKey, response []byte) ([]byte, error) {
+	sig, err := decodeRSASignature(response)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := key.conn.Raw(nil, "SETKEY %s", key.Keygrip); err != nil {
-		return nil, err
+	if diff := len(sig) - pubSize(pub); diff > 0 {
+		// It seems sometimes the signature can have leading zero bytes such that its over the keysize
+		leadingZeros := bytes.Repeat([]byte{00}, diff)
+		if !bytes.HasPrefix(sig, leadingZeros) {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: signature length too large with nonzero leading bytes")
+		}
+		// We trim the leading zeros
+		sig = bytes.TrimPrefix(sig, leadingZeros)
+	}
+
+	return sig, nil
+}
+
+// ecdsaHashes maps the digest sizes gpg-agent expects for ECDSA to the name
+// of a hash of that size.
+var ecdsaHashes = map[int]string{
+	32: "sha256",
+	48: "sha384",
+	64: "sha512",
+}
+
+func ecdsaSignOp(pub *ecdsa.PublicKey, digest []byte, opts crypto.SignerOpts) (signOp, error) {
+	var h crypto.Hash
+	if opts != nil {
+		h = opts.HashFunc()
+	}
+
+	// gpg-agent refuses digests shorter than the order of the curve, capped
+	// at 512 bits. Zero padding them on the left doesn't change the value
+	// that is signed, so the signature is still valid for the digest.
+	size := pub.Curve.Params().BitSize / 8
+	if size > 64 {
+		size = 64
+	}
+
+	if _, ok := ecdsaHashes[size]; ok && len(digest) < size {
+		digest = append(make([]byte, size-len(digest)), digest...)
+		h = 0
 	}
 
-	if err := key.conn.Raw(nil, "SETHASH --hash=%s %s", hashType, hex.EncodeToString(msg)); err != nil {
+	// Like ecdsa.PrivateKey, accept digests without knowing their hash.
+	// gpg-agent only checks the length of the digest against the hash, so
+	// pick one by length, which doesn't need the hash to be linked in.
+	if h == 0 {
+		hashType, ok := ecdsaHashes[len(digest)]
+		if !ok {
+			return signOp{}, fmt.Errorf("%d bytes: digest length not supported for ECDSA", len(digest))
+		}
+
+		return signOp{hashType: hashType, digest: digest, decode: decodeECDSASignature}, nil
+	}
+
+	hashType, err := hashType(h)
+	if err != nil {
+		return signOp{}, err
+	}
+
+	return signOp{hashType: hashType, digest: digest, decode: decodeECDSASignature}, nil
+}
+
+// sign has gpg-agent sign op and returns the decoded signature.
+func (key *Key) sign(ctx context.Context, op signOp) ([]byte, error) {
+	conn, release, err := key.acquire(ctx)
+	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	var response string
-	respFunc := func(respType, data string) error {
-		switch respType {
-		case "INQUIRE":
-			if err := key.conn.request("END"); err != nil {
-				return err
-			}
+	var sig []byte
+	err = conn.withPassphrase(ctx, key.passphraseRequest(), key.pinentry, func(inq inquiries) error {
+		if err := conn.RawContext(ctx, nil, "RESET"); err != nil {
+			return err
+		}
+
+		if err := conn.RawContext(ctx, nil, "SETKEY %s", key.Keygrip); err != nil {
+			return err
+		}
 
-		case "D":
-			response = data
+		if err := conn.setKeyDesc(ctx, key.pinentry); err != nil {
+			return err
 		}
 
-		return nil
+		var err error
+		sig, err = conn.pksign(ctx, op, inq)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if err := key.conn.Raw(respFunc, "PKSIGN"); err != nil {
+	return op.decode(sig)
+}
+
+// pksign sets the hash of op and has gpg-agent sign it with the key selected
+// by SETKEY. It returns the raw signature s-expression. The caller must hold
+// conn.mu.
+func (conn *Conn) pksign(ctx context.Context, op signOp, inq inquiries) ([]byte, error) {
+	var err error
+	if op.hashType != "" {
+		err = conn.RawContext(ctx, nil, "SETHASH --hash=%s %s", op.hashType, hex.EncodeToString(op.digest))
+	} else {
+		err = conn.setMessage(ctx, op.digest)
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return decodeRSASignature([]byte(response))
+	return conn.collect(ctx, nil, inq, "PKSIGN")
+}
+
+// passphraseRequest describes the passphrase or PIN unlocking this key.
+func (key *Key) passphraseRequest() PassphraseRequest {
+	req := PassphraseRequest{Keygrip: key.Keygrip}
+	if key.Type == StoredOnCard {
+		req.SerialNo = key.SerialNo
+	}
+
+	return req
+}
+
+// hashTypes maps the digest lengths gpg-agent accepts without --inquire to
+// a matching hash type.
+var hashTypes = map[int]string{
+	16: "md5",
+	20: "sha1",
+	28: "sha224",
+	32: "sha256",
+	48: "sha384",
+	64: "sha512",
+}
+
+// setMessage sets the message to sign with EdDSA. The caller must hold
+// conn.mu.
+func (conn *Conn) setMessage(ctx context.Context, msg []byte) error {
+	inquire, err := conn.hasOption(ctx, "SETHASH", "inquire")
+	if err != nil {
+		return err
+	}
+
+	if inquire {
+		tbs := inquiries{InquireTBSData: InquiryData(msg)}
+		return conn.transact(ctx, nil, tbs, "SETHASH --inquire")
+	}
+
+	// Older agents only take the message as a hash, which they sign as it
+	// is. That works as long as its length is valid for a hash.
+	hashType, ok := hashTypes[len(msg)]
+	if !ok {
+		return fmt.Errorf("%d bytes: message length not supported by this gpg-agent", len(msg))
+	}
+
+	return conn.RawContext(ctx, nil, "SETHASH --hash=%s %s", hashType, hex.EncodeToString(msg))
 }
@@ -3,8 +3,14 @@ package agent
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
 	"testing"
 
 	// Silent imports to make the hash type in crypto.SignerOpts work.
@@ -13,28 +19,40 @@ import (
 	"crypto/sha256"
 
 	"github.com/cognitive-i/gpg"
+	"github.com/cognitive-i/gpg/agent/agenttest"
+	"github.com/cognitive-i/gpg/agent/internal/x25519"
+	"github.com/cognitive-i/gpg/internal/brainpool"
 )
 
 func TestPublic(t *testing.T) {
-	keygrip := "FF47135C1C28599504C27AC6AE1117B6E02079BD"
-
-	key, err := conn.Key(keygrip)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		t.Fatalf("Key(%s): %s", keygrip, err)
+		t.Fatalf("GenerateKey(): %s", err)
 	}
 
-	if kg := gpg.Keygrip(key.Public()); kg != keygrip {
-		t.Fatalf("expected keygrip %q, but got %q", keygrip, kg)
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	if kg := gpg.Keygrip(key.Public()); kg != key.Keygrip {
+		t.Fatalf("expected keygrip %q, but got %q", key.Keygrip, kg)
 	}
 }
 
 func TestDecryptWithPKCS1v15(t *testing.T) {
-	keygrip := "3F0803C0B90C2F86A1153F7CC9ACC11AF1CCDA70"
-	key, err := conn.Key(keygrip)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		t.Fatalf("Key(%s): %s", keygrip, err)
+		t.Fatalf("GenerateKey(): %s", err)
 	}
 
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	testDecryptWithPKCS1v15(t, &key)
+}
+
+func testDecryptWithPKCS1v15(t *testing.T, key *Key) {
 	pub := key.Public().(*rsa.PublicKey)
 	message := []byte("Hello World PKCS1v15")
 
@@ -54,12 +72,19 @@ func TestDecryptWithPKCS1v15(t *testing.T) {
 }
 
 func TestDecryptWithOAEP(t *testing.T) {
-	keygrip := "3F0803C0B90C2F86A1153F7CC9ACC11AF1CCDA70"
-	key, err := conn.Key(keygrip)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		t.Fatalf("Key(%s): %s", keygrip, err)
+		t.Fatalf("GenerateKey(): %s", err)
 	}
 
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	testDecryptWithOAEP(t, &key)
+}
+
+func testDecryptWithOAEP(t *testing.T, key *Key) {
 	pub := key.Public().(*rsa.PublicKey)
 	message := []byte("Hello World OAEP")
 	label := []byte("label")
@@ -85,19 +110,25 @@ func TestDecryptWithOAEP(t *testing.T) {
 }
 
 func TestSignWithPKCS1v15(t *testing.T) {
-	keygrip := "C729393956A1361239C64EFB3DAC4D3735A003ED"
-
-	key, err := conn.Key(keygrip)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		t.Fatalf("Key(%s): %s", keygrip, err)
+		t.Fatalf("GenerateKey(): %s", err)
 	}
 
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	testSignWithPKCS1v15(t, &key)
+}
+
+func testSignWithPKCS1v15(t *testing.T, key *Key) {
 	msg := []byte("Hello World")
 	hashed := sha256.Sum256(msg)
 
 	sig, err := key.Sign(nil, hashed[:], crypto.SHA256)
 	if err != nil {
-		t.Fatalf("Sign(%s): %s", keygrip, err)
+		t.Fatalf("Sign(%s): %s", key.Keygrip, err)
 	}
 
 	rsaPub := key.publicKey.(*rsa.PublicKey)
@@ -107,13 +138,19 @@ func TestSignWithPKCS1v15(t *testing.T) {
 }
 
 func TestSignWithPSS(t *testing.T) {
-	keygrip := "C729393956A1361239C64EFB3DAC4D3735A003ED"
-
-	key, err := conn.Key(keygrip)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		t.Fatalf("Key(%s): %s", keygrip, err)
+		t.Fatalf("GenerateKey(): %s", err)
 	}
 
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	testSignWithPSS(t, &key)
+}
+
+func testSignWithPSS(t *testing.T, key *Key) {
 	msg := []byte("Hello World")
 	hashed := sha256.Sum256(msg)
 
@@ -124,7 +161,7 @@ func TestSignWithPSS(t *testing.T) {
 
 	sig, err := key.Sign(rand.Reader, hashed[:], opts)
 	if err != nil {
-		t.Fatalf("Sign(%s): %s", keygrip, err)
+		t.Fatalf("Sign(%s): %s", key.Keygrip, err)
 	}
 
 	rsaPub := key.publicKey.(*rsa.PublicKey)
@@ -132,3 +169,270 @@ func TestSignWithPSS(t *testing.T) {
 		t.Fatalf("VerifyPSS(): %s", err)
 	}
 }
+
+func TestRSAWithGpgAgent(t *testing.T) {
+	c := dialGpgAgent(t)
+	defer c.Close()
+
+	signing, err := c.Key("C729393956A1361239C64EFB3DAC4D3735A003ED")
+	if err != nil {
+		t.Fatalf("Key(): %s", err)
+	}
+
+	encryption, err := c.Key("3F0803C0B90C2F86A1153F7CC9ACC11AF1CCDA70")
+	if err != nil {
+		t.Fatalf("Key(): %s", err)
+	}
+
+	testSignWithPKCS1v15(t, &signing)
+	testSignWithPSS(t, &signing)
+	testDecryptWithPKCS1v15(t, &encryption)
+	testDecryptWithOAEP(t, &encryption)
+}
+
+// dialFakeAgent starts a fake gpg-agent and returns a connection to it.
+func dialFakeAgent(t *testing.T) (*agenttest.Server, *Conn) {
+	t.Helper()
+
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil)
+	if err != nil {
+		_ = s.Close()
+		t.Fatalf("Dial(): %s", err)
+	}
+
+	return s, c
+}
+
+// startFakeAgent starts a fake gpg-agent holding the specified private key
+// and returns a connection to it along with the key.
+func startFakeAgent(t *testing.T, priv crypto.PrivateKey) (*agenttest.Server, *Conn, Key) {
+	t.Helper()
+
+	s, c := dialFakeAgent(t)
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		_ = c.Close()
+		_ = s.Close()
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		_ = c.Close()
+		_ = s.Close()
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if kg := gpg.Keygrip(key.Public()); kg != keygrip {
+		_ = c.Close()
+		_ = s.Close()
+		t.Fatalf("expected keygrip %s, but got %s", keygrip, kg)
+	}
+
+	return s, c, key
+}
+
+func TestSignWithEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	if edPub, ok := key.Public().(ed25519.PublicKey); !ok || !bytes.Equal(edPub, pub) {
+		t.Fatalf("expected public key %x, but got %v", pub, key.Public())
+	}
+
+	msg := []byte("Hello World, this message is not a hash")
+	sig, err := key.Sign(nil, msg, crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Fatal("Verify(): invalid signature")
+	}
+
+	if _, err := key.Sign(nil, msg, crypto.SHA256); err == nil {
+		t.Fatal("expected an error when signing a hashed message")
+	}
+}
+
+func TestSignWithEd25519WithoutInquire(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, c, key := startFakeAgent(t, priv)
+	defer s.Close()
+	defer c.Close()
+
+	// Behave like gpg-agent 2.2, which has no SETHASH --inquire.
+	s.Inject("GETINFO", agenttest.Fault{Err: agenttest.NewError(4, 256, "False")})
+
+	msg := sha256.Sum256([]byte("Hello World"))
+	sig, err := key.Sign(nil, msg[:], crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), msg[:], sig) {
+		t.Fatal("Verify(): invalid signature")
+	}
+
+	if _, err := key.Sign(nil, []byte("Hello World"), crypto.Hash(0)); err == nil {
+		t.Fatal("expected an error when signing a message that doesn't look like a hash")
+	}
+}
+
+func TestSignWithECDSA(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521(), brainpool.P384r1()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey(%s): %s", curve.Params().Name, err)
+		}
+
+		s, c, key := startFakeAgent(t, priv)
+
+		pub, ok := key.Public().(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().Name != curve.Params().Name || pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+			t.Errorf("expected public key %v, but got %v", priv.Public(), key.Public())
+		}
+
+		// SHA-256 is shorter than most of the curves, which gpg-agent
+		// refuses unless the digest is padded.
+		hashed := sha256.Sum256([]byte("Hello World"))
+		sig, err := key.Sign(nil, hashed[:], crypto.SHA256)
+		if err != nil {
+			t.Errorf("Sign(%s): %s", curve.Params().Name, err)
+		} else if err := verifyECDSA(&priv.PublicKey, hashed[:], sig); err != nil {
+			t.Errorf("verifyECDSA(%s): %s", curve.Params().Name, err)
+		}
+
+		// Like ecdsa.PrivateKey, the key must cope without SignerOpts.
+		sig, err = key.Sign(nil, hashed[:], nil)
+		if err != nil {
+			t.Errorf("Sign(%s) without options: %s", curve.Params().Name, err)
+		} else if err := verifyECDSA(&priv.PublicKey, hashed[:], sig); err != nil {
+			t.Errorf("verifyECDSA(%s) without options: %s", curve.Params().Name, err)
+		}
+
+		_ = c.Close()
+		_ = s.Close()
+	}
+}
+
+func verifyECDSA(pub *ecdsa.PublicKey, digest, sig []byte) error {
+	var rs struct {
+		R, S *big.Int
+	}
+
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil {
+		return err
+	} else if len(rest) != 0 {
+		return errors.New("trailing data after signature")
+	}
+
+	if !ecdsa.Verify(pub, digest, rs.R, rs.S) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+func TestECDHWithX25519(t *testing.T) {
+	priv := make([]byte, x25519.Size)
+	ephemeral := make([]byte, x25519.Size)
+	if _, err := rand.Read(priv); err != nil {
+		t.Fatalf("Read(): %s", err)
+	}
+	if _, err := rand.Read(ephemeral); err != nil {
+		t.Fatalf("Read(): %s", err)
+	}
+
+	s, c, key := startFakeAgent(t, agenttest.X25519PrivateKey(priv))
+	defer s.Close()
+	defer c.Close()
+
+	pub, ok := key.Public().(X25519PublicKey)
+	if !ok || !bytes.Equal(pub, x25519.X25519(priv, x25519.Basepoint)) {
+		t.Fatalf("unexpected public key %v", key.Public())
+	}
+
+	// Pass the ephemeral key the way OpenPGP encodes it.
+	ephemeralPub := append([]byte{0x40}, x25519.X25519(ephemeral, x25519.Basepoint)...)
+	shared, err := key.ECDH(ephemeralPub)
+	if err != nil {
+		t.Fatalf("ECDH(): %s", err)
+	}
+
+	if expected := x25519.X25519(ephemeral, pub); !bytes.Equal(shared, expected) {
+		t.Fatalf("expected shared secret %x, but got %x", expected, shared)
+	}
+}
+
+func TestECDHWithCardKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	keygrip, err := s.AddKey(agenttest.Key{
+		Keygrip:    "50D085844B7EDC2B4E86C5146FB4A5727BB1B545",
+		PrivateKey: priv,
+		SerialNo:   "D2760001240103040006123456780000",
+		CardID:     "OPENPGP.2",
+	})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if key.Type != StoredOnCard {
+		t.Errorf("expected the key to be stored on a card, but got type %d", key.Type)
+	}
+
+	shared, err := key.ECDH(elliptic.Marshal(elliptic.P256(), ephemeral.X, ephemeral.Y))
+	if err != nil {
+		t.Fatalf("ECDH(): %s", err)
+	}
+
+	x, _ := elliptic.P256().ScalarMult(priv.X, priv.Y, ephemeral.D.Bytes())
+	if len(shared) != 32 || x.Cmp(new(big.Int).SetBytes(shared)) != 0 {
+		t.Fatalf("expected shared secret %x, but got %x", x, shared)
+	}
+
+	if _, err := key.ECDH([]byte{4, 1, 2, 3}); err == nil {
+		t.Fatal("expected an error for an invalid ephemeral key")
+	}
+}
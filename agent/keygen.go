@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/abesto/sexp"
+	"github.com/cognitive-i/gpg"
+)
+
+// KeyAlgorithm selects the type of key created by GenerateKey. The names
+// match the ones used by gpg --quick-generate-key.
+type KeyAlgorithm string
+
+// These are the key algorithms supported by GenerateKey.
+const (
+	RSA2048    KeyAlgorithm = "rsa2048"
+	RSA3072    KeyAlgorithm = "rsa3072"
+	RSA4096    KeyAlgorithm = "rsa4096"
+	Ed25519    KeyAlgorithm = "ed25519"
+	Curve25519 KeyAlgorithm = "cv25519"
+	NISTP256   KeyAlgorithm = "nistp256"
+	NISTP384   KeyAlgorithm = "nistp384"
+	NISTP521   KeyAlgorithm = "nistp521"
+)
+
+// GenerateKeyOptions configures GenerateKey.
+type GenerateKeyOptions struct {
+	// NoProtection stores the key without protecting it with a passphrase.
+	NoProtection bool
+
+	// Passphrase protects the key. It's handed to gpg-agent through the
+	// NEWPASSWD inquiry. If it's nil and NoProtection isn't set, gpg-agent
+	// asks for a passphrase with pinentry.
+	Passphrase []byte
+
+	// Preset adds the passphrase of the new key to gpg-agent's cache.
+	Preset bool
+
+	// Created is recorded as the creation time of the key. If it's zero,
+	// gpg-agent uses the current time.
+	Created time.Time
+}
+
+// keyParam returns the s-expression answering the KEYPARAM inquiry, built
+// the same way as gpg does.
+func (algo KeyAlgorithm) keyParam() ([]byte, error) {
+	var params []interface{}
+	switch algo {
+	case RSA2048, RSA3072, RSA4096:
+		params = []interface{}{
+			[]byte("rsa"),
+			[]interface{}{[]byte("nbits"), []byte(strings.TrimPrefix(string(algo), "rsa"))},
+		}
+
+	case Ed25519:
+		params = []interface{}{
+			[]byte("ecc"),
+			[]interface{}{[]byte("curve"), []byte("Ed25519")},
+			[]interface{}{[]byte("flags"), []byte("eddsa"), []byte("comp")},
+		}
+
+	case Curve25519:
+		params = []interface{}{
+			[]byte("ecc"),
+			[]interface{}{[]byte("curve"), []byte("Curve25519")},
+			[]interface{}{[]byte("flags"), []byte("djb-tweak"), []byte("comp")},
+		}
+
+	case NISTP256, NISTP384, NISTP521:
+		params = []interface{}{
+			[]byte("ecc"),
+			[]interface{}{[]byte("curve"), []byte("NIST P-" + strings.TrimPrefix(string(algo), "nistp"))},
+			[]interface{}{[]byte("flags"), []byte("nocomp")},
+		}
+
+	default:
+		return nil, fmt.Errorf("%s: unsupported key algorithm", algo)
+	}
+
+	return sexp.Marshal([]interface{}{[]byte("genkey"), params}, true)
+}
+
+// GenerateKey creates a new key stored by gpg-agent and returns it. If opts
+// is nil, gpg-agent asks for the passphrase protecting the key with pinentry.
+func (conn *Conn) GenerateKey(algo KeyAlgorithm, opts *GenerateKeyOptions) (Key, error) {
+	return conn.GenerateKeyContext(context.Background(), algo, opts)
+}
+
+// GenerateKeyContext is like GenerateKey, but aborts the operation when ctx
+// is done.
+func (conn *Conn) GenerateKeyContext(ctx context.Context, algo KeyAlgorithm, opts *GenerateKeyOptions) (Key, error) {
+	if opts == nil {
+		opts = &GenerateKeyOptions{}
+	}
+
+	param, err := algo.keyParam()
+	if err != nil {
+		return Key{}, err
+	}
+
+	cmd := []string{"GENKEY"}
+	inq := inquiries{InquireKeyParam: InquiryData(param)}
+	if opts.NoProtection {
+		cmd = append(cmd, "--no-protection")
+	} else if opts.Passphrase != nil {
+		cmd = append(cmd, "--inq-passwd")
+		inq[InquireNewPasswd] = InquiryData(opts.Passphrase)
+	}
+	if opts.Preset {
+		cmd = append(cmd, "--preset")
+	}
+	if !opts.Created.IsZero() {
+		cmd = append(cmd, "--timestamp="+opts.Created.UTC().Format("20060102T150405"))
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	data, err := conn.collect(ctx, nil, inq, "%s", strings.Join(cmd, " "))
+	if err != nil {
+		return Key{}, err
+	}
+
+	pub, err := decodePublicKey(data)
+	if err != nil {
+		return Key{}, err
+	}
+
+	keygrip, err := gpg.ComputeKeygrip(pub)
+	if err != nil {
+		return Key{}, err
+	}
+
+	return conn.key(ctx, keygrip)
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cognitive-i/gpg"
+)
+
+func TestGenerateKey(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	for _, test := range []struct {
+		algo KeyAlgorithm
+		pub  crypto.PublicKey
+		bits int
+	}{
+		{RSA2048, &rsa.PublicKey{}, 2048},
+		{Ed25519, ed25519.PublicKey{}, 256},
+		{Curve25519, X25519PublicKey{}, 256},
+		{NISTP256, &ecdsa.PublicKey{}, 256},
+		{NISTP384, &ecdsa.PublicKey{}, 384},
+		{NISTP521, &ecdsa.PublicKey{}, 521},
+	} {
+		key, err := c.GenerateKey(test.algo, &GenerateKeyOptions{NoProtection: true})
+		if err != nil {
+			t.Errorf("GenerateKey(%s): %s", test.algo, err)
+			continue
+		}
+
+		if reflect.TypeOf(key.Public()) != reflect.TypeOf(test.pub) {
+			t.Errorf("%s: expected a %T, but got %T", test.algo, test.pub, key.Public())
+			continue
+		}
+
+		bits := test.bits
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			bits = pub.N.BitLen()
+		case *ecdsa.PublicKey:
+			bits = pub.Curve.Params().BitSize
+		}
+
+		if bits != test.bits {
+			t.Errorf("%s: expected a key of %d bits, but got %d", test.algo, test.bits, bits)
+		}
+
+		if kg := gpg.Keygrip(key.Public()); kg != key.Keygrip {
+			t.Errorf("%s: expected keygrip %s, but got %s", test.algo, key.Keygrip, kg)
+		}
+
+		if key.Type != StoredOnDisk || key.Protection != ProtByNothing {
+			t.Errorf("%s: unexpected key %+v", test.algo, key)
+		}
+	}
+}
+
+func TestGenerateKeyWithPassphrase(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	opts := &GenerateKeyOptions{
+		Passphrase: []byte("secret"),
+		Preset:     true,
+		Created:    time.Unix(1600000000, 0),
+	}
+
+	key, err := c.GenerateKey(Ed25519, opts)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	if key.Protection != ProtByPassphrase || !key.Cached {
+		t.Errorf("expected a protected and cached key, but got %+v", key)
+	}
+
+	digest := sha256.Sum256([]byte("Hello World"))
+	sig, err := key.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), digest[:], sig) {
+		t.Errorf("invalid signature")
+	}
+}
+
+func TestGenerateKeyUnsupported(t *testing.T) {
+	s, c := dialFakeAgent(t)
+	defer s.Close()
+	defer c.Close()
+
+	if _, err := c.GenerateKey("dsa1024", nil); err == nil {
+		t.Errorf("expected an error")
+	} else if errors.As(err, new(Error)) {
+		t.Errorf("expected the key to be rejected before contacting gpg-agent, but got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package agent
+
+// DialOption configures how Dial finds and connects to gpg-agent.
+type DialOption func(*dialConfig)
+
+// dialConfig holds the settings collected from the DialOptions.
+type dialConfig struct {
+	homedir string
+	socket  Socket
+
+	autostart    bool
+	agentProgram string
+
+	loopback bool
+	provider PassphraseProvider
+
+	session *SessionOptions
+
+	reconnect bool
+}
+
+func newDialConfig(opts []DialOption) *dialConfig {
+	cfg := &dialConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// WithHomedir makes Dial look for the socket of the gpg-agent serving the
+// specified GnuPG home directory, instead of the default one.
+func WithHomedir(homedir string) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.homedir = homedir
+	}
+}
+
+// WithSocket makes Dial connect to the specified socket of gpg-agent, such as
+// the restricted SocketExtra, instead of SocketStandard.
+func WithSocket(socket Socket) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.socket = socket
+	}
+}
+
+// WithAutostart makes Dial launch gpg-agent as a daemon when nothing is
+// listening on its socket yet, just like gpg does. Other errors dialing the
+// socket, such as a lack of permissions, are returned right away.
+func WithAutostart() DialOption {
+	return func(cfg *dialConfig) {
+		cfg.autostart = true
+	}
+}
+
+// WithAgentProgram sets the gpg-agent executable launched by WithAutostart.
+// By default gpg-agent is looked up in the PATH.
+func WithAgentProgram(program string) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.agentProgram = program
+	}
+}
+
+// WithPinentryLoopback sets the pinentry-mode of the connection to loopback,
+// so gpg-agent inquires passphrases and PINs from the client instead of
+// showing a pinentry. They are answered by provider, or by the handlers
+// registered with HandleInquiry if provider is nil.
+//
+// gpg-agent must allow this, which it does by default since GnuPG 2.1.12.
+func WithPinentryLoopback(provider PassphraseProvider) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.loopback = true
+		cfg.provider = provider
+	}
+}
+
+// WithSessionOptions makes Dial pass opts on to gpg-agent, so its pinentry
+// appears on the terminal or desktop session they describe. Use
+// InheritSessionOptions for the one of the current process, just like gpg
+// does. Options passed to Dial directly take precedence.
+func WithSessionOptions(opts *SessionOptions) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.session = opts
+	}
+}
+
+// WithReconnect makes the connection dial gpg-agent again when it finds that
+// the connection broke down, such as after gpg-agent was restarted. The
+// options of the session are set again on the new connection, and commands
+// which are safe to repeat, such as KEYINFO, READKEY and GETINFO, are retried
+// once if the connection breaks down before gpg-agent answers them. Other
+// commands fail, but the next one reconnects.
+//
+// State kept by gpg-agent for the session, such as a key selected with
+// SETKEY, is lost when reconnecting. Operations sending several commands,
+// such as Key.Sign, therefore only reconnect before their first command: if
+// the connection breaks down halfway, they fail with the error it broke down
+// with, and the next operation reconnects.
+func WithReconnect() DialOption {
+	return func(cfg *dialConfig) {
+		cfg.reconnect = true
+	}
+}
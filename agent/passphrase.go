@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"strings"
+)
+
+// ChangePassphraseOptions configures ChangePassphrase.
+type ChangePassphraseOptions struct {
+	// Passphrase is the current passphrase of the key. It's only needed if
+	// the passphrase isn't cached, and only used along with NewPassphrase.
+	// If it's nil, the PassphraseProvider set by Dial or the handler
+	// registered with HandleInquiry for InquirePassphrase is asked instead.
+	Passphrase []byte
+
+	// NewPassphrase replaces the passphrase of the key. It's handed to
+	// gpg-agent through a loopback pinentry, and an empty one removes the
+	// protection of the key. If it's nil, gpg-agent asks for both
+	// passphrases through pinentry, or the PassphraseProvider set by Dial.
+	NewPassphrase []byte
+
+	// Preset adds the new passphrase to the cache of gpg-agent.
+	Preset bool
+}
+
+// ChangePassphrase changes the passphrase protecting this key.
+func (key *Key) ChangePassphrase(opts *ChangePassphraseOptions) error {
+	return key.ChangePassphraseContext(context.Background(), opts)
+}
+
+// ChangePassphraseContext is like ChangePassphrase, but aborts the operation
+// when ctx is done.
+func (key *Key) ChangePassphraseContext(ctx context.Context, opts *ChangePassphraseOptions) error {
+	if opts == nil {
+		opts = &ChangePassphraseOptions{}
+	}
+
+	cmd := []string{"PASSWD"}
+	if opts.Preset {
+		cmd = append(cmd, "--preset")
+	}
+	cmd = append(cmd, key.Keygrip)
+
+	conn, release, err := key.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return conn.withPassphrase(ctx, key.passphraseRequest(), key.pinentry, func(inq inquiries) error {
+		if opts.NewPassphrase == nil {
+			return conn.transact(ctx, nil, inq, "%s", strings.Join(cmd, " "))
+		}
+
+		inq[InquireNewPassphrase] = InquiryData(opts.NewPassphrase)
+		if opts.Passphrase != nil {
+			inq[InquirePassphrase] = InquiryData(opts.Passphrase)
+		}
+
+		return conn.loopback(ctx, func() error {
+			return conn.transact(ctx, nil, inq, "%s", strings.Join(cmd, " "))
+		})
+	})
+}
+
+// PresetPassphrase adds the passphrase of the key with the specified keygrip
+// to the cache of gpg-agent, so it can be used without asking for the
+// passphrase. This requires gpg-agent to run with allow-preset-passphrase.
+//
+// Preset passphrases never expire, as gpg-agent doesn't support a timeout
+// for them; use ClearPassphrase to remove them again. The default-cache-ttl
+// and max-cache-ttl of gpg-agent.conf, such as Options.DefaultCacheTTL and
+// Options.MaxCacheTTL of the ephemeral package, only apply to passphrases
+// cached after asking for them.
+func (conn *Conn) PresetPassphrase(keygrip string, passphrase []byte) error {
+	return conn.PresetPassphraseContext(context.Background(), keygrip, passphrase)
+}
+
+// PresetPassphraseContext is like PresetPassphrase, but aborts the operation
+// when ctx is done.
+func (conn *Conn) PresetPassphraseContext(ctx context.Context, keygrip string, passphrase []byte) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	// The passphrase is inquired, rather than passed on the command line
+	// where it would show up in the logs of gpg-agent.
+	inq := inquiries{InquirePassphrase: InquiryData(passphrase)}
+	return conn.transact(ctx, nil, inq, "PRESET_PASSPHRASE --inquire %s -1", keygrip)
+}
+
+// ClearPassphrase removes the passphrase of the key with the specified
+// keygrip from the cache of gpg-agent.
+func (conn *Conn) ClearPassphrase(keygrip string) error {
+	return conn.ClearPassphraseContext(context.Background(), keygrip)
+}
+
+// ClearPassphraseContext is like ClearPassphrase, but aborts the operation
+// when ctx is done.
+func (conn *Conn) ClearPassphraseContext(ctx context.Context, keygrip string) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.RawContext(ctx, nil, "CLEAR_PASSPHRASE --mode=normal %s", keygrip)
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+// startProtectedAgent starts a fake gpg-agent holding an ed25519 key
+// protected by passphrase and returns a connection to it, dialed with opts,
+// along with the keygrip of the key.
+func startProtectedAgent(t *testing.T, allowPreset bool, passphrase string, opts ...DialOption) (*agenttest.Server, *Conn, string) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	s.AllowPresetPassphrase = allowPreset
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, Protected: true, Passphrase: []byte(passphrase)})
+	if err != nil {
+		_ = s.Close()
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil, opts...)
+	if err != nil {
+		_ = s.Close()
+		t.Fatalf("Dial(): %s", err)
+	}
+
+	return s, c, keygrip
+}
+
+func TestChangePassphrase(t *testing.T) {
+	s, c, keygrip := startProtectedAgent(t, false, "secret")
+	defer s.Close()
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	// The fake agent has no pinentry to ask for the passphrases.
+	if err := key.ChangePassphrase(nil); !errors.Is(err, ErrNoPinentry) {
+		t.Errorf("expected %v, but got %v", ErrNoPinentry, err)
+	}
+
+	opts := &ChangePassphraseOptions{Passphrase: []byte("wrong"), NewPassphrase: []byte("new")}
+	if err := key.ChangePassphrase(opts); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("expected %v, but got %v", ErrBadPassphrase, err)
+	}
+
+	for _, test := range []struct {
+		opts       ChangePassphraseOptions
+		protection KeyProtection
+		cached     bool
+	}{
+		{ChangePassphraseOptions{Passphrase: []byte("secret"), NewPassphrase: []byte("new")}, ProtByPassphrase, false},
+		{ChangePassphraseOptions{Passphrase: []byte("new"), NewPassphrase: []byte("newer"), Preset: true}, ProtByPassphrase, true},
+		{ChangePassphraseOptions{NewPassphrase: []byte{}}, ProtByNothing, false},
+	} {
+		opts := test.opts
+		if err := key.ChangePassphrase(&opts); err != nil {
+			t.Errorf("ChangePassphrase(%+v): %s", opts, err)
+			continue
+		}
+
+		key, err := c.Key(keygrip)
+		if err != nil {
+			t.Fatalf("Key(%s): %s", keygrip, err)
+		}
+
+		if key.Protection != test.protection || key.Cached != test.cached {
+			t.Errorf("%+v: unexpected key %+v", opts, key)
+		}
+	}
+
+	// The pinentry-mode must be restored once the passphrase is changed.
+	if err := key.ChangePassphrase(nil); !errors.Is(err, ErrNoPinentry) {
+		t.Errorf("expected %v, but got %v", ErrNoPinentry, err)
+	}
+}
+
+func TestPresetPassphrase(t *testing.T) {
+	s, c, keygrip := startProtectedAgent(t, true, "secret")
+	defer s.Close()
+	defer c.Close()
+
+	if err := c.PresetPassphrase(keygrip, []byte("secret")); err != nil {
+		t.Fatalf("PresetPassphrase(): %s", err)
+	}
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if !key.Cached {
+		t.Errorf("expected a cached passphrase, but got %+v", key)
+	}
+
+	// Without a pinentry, the key can only be exported with the cached
+	// passphrase.
+	if _, err := key.Export(); err != nil {
+		t.Errorf("Export(): %s", err)
+	}
+
+	if err := c.ClearPassphrase(keygrip); err != nil {
+		t.Fatalf("ClearPassphrase(): %s", err)
+	}
+
+	if key, err = c.Key(keygrip); err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if key.Cached {
+		t.Errorf("expected the passphrase to be cleared, but got %+v", key)
+	}
+
+	if _, err := key.Export(); !errors.Is(err, ErrNoPinentry) {
+		t.Errorf("expected %v, but got %v", ErrNoPinentry, err)
+	}
+}
+
+func TestPresetPassphraseNotAllowed(t *testing.T) {
+	s, c, keygrip := startProtectedAgent(t, false, "secret")
+	defer s.Close()
+	defer c.Close()
+
+	if err := c.PresetPassphrase(keygrip, []byte("secret")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected %v, but got %v", ErrNotSupported, err)
+	}
+}
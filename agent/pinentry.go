@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// passphraseTries is how often an operation is attempted when the
+// PassphraseProvider supplies a wrong passphrase, just like gpg-agent asks
+// its pinentry three times.
+const passphraseTries = 3
+
+// PassphraseRequest describes a passphrase or PIN gpg-agent asks for in
+// loopback pinentry mode.
+type PassphraseRequest struct {
+	// Keyword is the keyword of the inquiry, such as InquirePassphrase,
+	// InquireNewPassphrase or InquireNeedPIN.
+	Keyword string
+
+	// Keygrip identifies the key the passphrase is asked for, if any.
+	Keygrip string
+
+	// SerialNo identifies the smart card the PIN is asked for, if any.
+	SerialNo string
+
+	// Description is the text a pinentry would show, taken from the
+	// PinentryOptions of the operation or else sent along with the inquiry.
+	Description string
+
+	// Attempt counts the attempts of the operation, starting at 1. Err is
+	// the error the previous attempt failed with.
+	Attempt int
+	Err     error
+
+	// PINRetries is the number of attempts left before the PIN of a smart
+	// card is blocked, as last reported by the card. It's zero if it's not
+	// known, or if no PIN is asked for. Wrong PINs are never retried.
+	PINRetries int
+}
+
+// PassphraseProvider supplies the passphrases and PINs gpg-agent asks for.
+type PassphraseProvider interface {
+	// Passphrase returns the passphrase or PIN for req. The returned slice
+	// is zeroed once it has been sent to gpg-agent. Returning an error
+	// cancels the operation.
+	Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error)
+}
+
+// PassphraseFunc is an adapter to use a function as a PassphraseProvider.
+type PassphraseFunc func(ctx context.Context, req PassphraseRequest) ([]byte, error)
+
+// Passphrase calls f(ctx, req).
+func (f PassphraseFunc) Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error) {
+	return f(ctx, req)
+}
+
+// PinentryOptions customize how the passphrase or PIN is asked for during
+// the operations of a Key or Card returned by its WithPinentry method. Only
+// the description and the user data reach the pinentry of gpg-agent, which
+// has no way to set its window title or prompt.
+type PinentryOptions struct {
+	// Description replaces the default text shown by pinentry when signing,
+	// decrypting or exporting with a key. Like gpg-agent, a description
+	// containing "PIN" labels the entry box with "PIN". A PassphraseProvider
+	// sees it for smart card PINs as well.
+	Description string
+
+	// UserData is handed to pinentry in the PINENTRY_USER_DATA environment
+	// variable. It must not contain control characters.
+	UserData string
+}
+
+// WithPinentry returns a copy of the key whose operations ask for the
+// passphrase as described by opts.
+func (key *Key) WithPinentry(opts *PinentryOptions) *Key {
+	k := *key
+	k.pinentry = opts
+	return &k
+}
+
+// WithPinentry returns a copy of the card whose operations ask for the PIN
+// as described by opts.
+func (card *Card) WithPinentry(opts *PinentryOptions) *Card {
+	c := *card
+	c.pinentry = opts
+	return &c
+}
+
+// setKeyDesc sends the description of opts, if any, for the next operation
+// with a key. The caller must hold conn.mu.
+func (conn *Conn) setKeyDesc(ctx context.Context, opts *PinentryOptions) error {
+	if opts == nil || opts.Description == "" {
+		return nil
+	}
+
+	return conn.RawContext(ctx, nil, "SETKEYDESC %s", plusEscape(opts.Description))
+}
+
+// withPassphrase runs f with the inquiries answering passphrases and PINs
+// through the PassphraseProvider set by Dial, if any. f is run again when
+// the provider gave a wrong passphrase, up to passphraseTries times, unless
+// it's for a smart card. opts, if not nil, apply while f runs, as a single
+// sequence of commands (see begin). The caller must hold conn.mu.
+func (conn *Conn) withPassphrase(ctx context.Context, req PassphraseRequest, opts *PinentryOptions, f func(inq inquiries) error) (err error) {
+	end, err := conn.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	if opts == nil {
+		opts = &PinentryOptions{}
+	}
+	req.Description = opts.Description
+
+	if opts.UserData != "" {
+		if strings.IndexFunc(opts.UserData, isControl) >= 0 {
+			return errors.New("github.com/cognitive-i/gpg/agent: pinentry user data contains control characters")
+		}
+
+		if err := conn.RawContext(ctx, nil, "OPTION pinentry-user-data=%s", opts.UserData); err != nil {
+			return err
+		}
+		defer func() {
+			// gpg-agent rejects empty values, but unsets the option
+			// without one.
+			reset := "OPTION pinentry-user-data"
+			if userData, ok := conn.sessionOption("pinentry-user-data"); ok && userData != "" {
+				reset += "=" + userData
+			}
+
+			if resetErr := conn.RawContext(ctx, nil, "%s", reset); err == nil {
+				err = resetErr
+			}
+		}()
+	}
+
+	for req.Attempt = 1; ; req.Attempt++ {
+		asked := false
+		inq := inquiries{}
+		if conn.provider != nil {
+			answer := func(ctx context.Context, inquiry Inquiry, w io.Writer) error {
+				r := req
+				r.Keyword = inquiry.Keyword
+				if prompt := inquiry.Prompt(); prompt != "" && r.Description == "" {
+					r.Description = prompt
+				}
+
+				secret, err := conn.provider.Passphrase(ctx, r)
+				if err != nil {
+					return err
+				}
+				defer wipe(secret)
+
+				asked = true
+				_, err = w.Write(secret)
+				return err
+			}
+
+			for _, keyword := range []string{InquirePassphrase, InquireNewPassphrase, InquireNeedPIN} {
+				inq[keyword] = answer
+			}
+		}
+
+		// Wrong PINs count against the retry counter of the card, so leave
+		// retrying them to the caller.
+		err = f(inq)
+		if !asked || req.SerialNo != "" || !errors.Is(err, ErrBadPassphrase) || req.Attempt >= passphraseTries {
+			return err
+		}
+
+		req.Err = err
+	}
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+// passphraseRecorder is a PassphraseProvider answering with the passphrases
+// it's given in turn, and recording the requests and its answers.
+type passphraseRecorder struct {
+	passphrases []string
+	requests    []PassphraseRequest
+	answers     [][]byte
+}
+
+func (p *passphraseRecorder) Passphrase(ctx context.Context, req PassphraseRequest) ([]byte, error) {
+	p.requests = append(p.requests, req)
+	if len(p.answers) >= len(p.passphrases) {
+		return nil, errors.New("out of passphrases")
+	}
+
+	answer := []byte(p.passphrases[len(p.answers)])
+	p.answers = append(p.answers, answer)
+	return answer, nil
+}
+
+// wiped reports whether all answers were zeroed after use.
+func (p *passphraseRecorder) wiped() bool {
+	for _, answer := range p.answers {
+		if !bytes.Equal(answer, make([]byte, len(answer))) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestPinentryLoopback(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, Protected: true, Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	p := &passphraseRecorder{passphrases: []string{"wrong", "secret"}}
+	c, err := Dial(s.Socket, nil, WithPinentryLoopback(p))
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	sig, err := key.Sign(rand.Reader, []byte("Hello World"), nil)
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), []byte("Hello World"), sig) {
+		t.Errorf("invalid signature")
+	}
+
+	if len(p.requests) != 2 {
+		t.Fatalf("expected 2 requests, but got %+v", p.requests)
+	}
+
+	for i, req := range p.requests {
+		if req.Keyword != InquirePassphrase || req.Keygrip != keygrip || req.Attempt != i+1 {
+			t.Errorf("unexpected request %+v", req)
+		}
+	}
+
+	if err := p.requests[1].Err; !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("expected the retry to report %v, but got %v", ErrBadPassphrase, err)
+	}
+
+	if !p.wiped() {
+		t.Errorf("expected the passphrases to be zeroed, but got %q", p.answers)
+	}
+}
+
+func TestPinentryLoopbackTries(t *testing.T) {
+	p := &passphraseRecorder{passphrases: []string{"a", "b", "c", "d"}}
+	s, c, keygrip := startProtectedAgent(t, false, "secret", WithPinentryLoopback(p))
+	defer s.Close()
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	if _, err := key.Export(); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("expected %v, but got %v", ErrBadPassphrase, err)
+	}
+
+	if len(p.requests) != passphraseTries {
+		t.Errorf("expected %d requests, but got %+v", passphraseTries, p.requests)
+	}
+
+	p.passphrases = nil
+	p.answers = nil
+	if _, err := key.Export(); err == nil || err.Error() != "out of passphrases" {
+		t.Errorf("expected the error of the provider, but got %v", err)
+	}
+}
+
+func TestPinentryLoopbackCard(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	s.SetCard(&agenttest.Card{
+		Serial:    "D2760001240103040006123456780000",
+		AppType:   "OPENPGP",
+		CHVStatus: "+1+127+127+127+3+0+2",
+		PIN:       "123456",
+		AdminPIN:  "12345678",
+	})
+
+	p := &passphraseRecorder{passphrases: []string{"123456", "12345678", "000000"}}
+	c, err := Dial(s.Socket, nil, WithPinentryLoopback(p))
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	card, err := c.CurrentCard()
+	if err != nil {
+		t.Fatalf("CurrentCard(): %s", err)
+	}
+
+	if err := card.CheckPIN(false); err != nil {
+		t.Errorf("CheckPIN(): %s", err)
+	}
+
+	if err := card.CheckPIN(true); err != nil {
+		t.Errorf("CheckPIN(admin): %s", err)
+	}
+
+	// Wrong PINs are never retried.
+	if err := card.CheckPIN(false); !IsBadPIN(err) {
+		t.Errorf("expected a bad PIN, but got %v", err)
+	}
+
+	if len(p.requests) != 3 {
+		t.Fatalf("expected 3 requests, but got %+v", p.requests)
+	}
+
+	for i, expected := range []PassphraseRequest{
+		{Keyword: InquireNeedPIN, SerialNo: card.Serial, Description: "||Please enter the PIN", Attempt: 1, PINRetries: 3},
+		{Keyword: InquireNeedPIN, SerialNo: card.Serial, Description: "|A|Please enter the Admin PIN", Attempt: 1, PINRetries: 2},
+		{Keyword: InquireNeedPIN, SerialNo: card.Serial, Description: "||Please enter the PIN", Attempt: 1, PINRetries: 3},
+	} {
+		if p.requests[i] != expected {
+			t.Errorf("expected request %+v, but got %+v", expected, p.requests[i])
+		}
+	}
+}
+
+func TestPinentryOptions(t *testing.T) {
+	s, c, keygrip := startProtectedAgent(t, false, "secret")
+	defer s.Close()
+	defer c.Close()
+
+	type prompt struct{ desc, userData string }
+	var prompts []prompt
+	s.Pinentry = func(desc, userData string) ([]byte, error) {
+		prompts = append(prompts, prompt{desc, userData})
+		return []byte("secret"), nil
+	}
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	opts := &PinentryOptions{Description: "Sign release v1.4.2 for repo X\n100% + \"more\"", UserData: "release-bot"}
+	msg := make([]byte, 32)
+	if _, err := key.WithPinentry(opts).Sign(rand.Reader, msg, nil); err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if err := c.ClearPassphrase(keygrip); err != nil {
+		t.Fatalf("ClearPassphrase(): %s", err)
+	}
+
+	// Neither the description nor the user data outlive the operation.
+	if _, err := key.Sign(rand.Reader, msg, nil); err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	expected := []prompt{{opts.Description, opts.UserData}, {}}
+	if len(prompts) != len(expected) || prompts[0] != expected[0] || prompts[1] != expected[1] {
+		t.Errorf("expected prompts %q, but got %q", expected, prompts)
+	}
+
+	opts = &PinentryOptions{UserData: "line\nbreak"}
+	if _, err := key.WithPinentry(opts).Sign(rand.Reader, msg, nil); err == nil {
+		t.Errorf("expected user data with control characters to be rejected")
+	}
+}
+
+func TestPinentryOptionsLoopback(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, Protected: true, Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	s.SetCard(&agenttest.Card{
+		Serial:    "D2760001240103040006123456780000",
+		AppType:   "OPENPGP",
+		CHVStatus: "+1+127+127+127+3+0+2",
+		PIN:       "123456",
+	})
+
+	p := &passphraseRecorder{passphrases: []string{"secret", "123456"}}
+	c, err := Dial(s.Socket, nil, WithPinentryLoopback(p))
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	card, err := c.CurrentCard()
+	if err != nil {
+		t.Fatalf("CurrentCard(): %s", err)
+	}
+
+	opts := &PinentryOptions{Description: "Sign release v1.4.2 for repo X"}
+	if _, err := key.WithPinentry(opts).Sign(rand.Reader, make([]byte, 32), nil); err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if err := card.WithPinentry(opts).CheckPIN(false); err != nil {
+		t.Fatalf("CheckPIN(): %s", err)
+	}
+
+	if len(p.requests) != 2 {
+		t.Fatalf("expected 2 requests, but got %+v", p.requests)
+	}
+
+	for _, req := range p.requests {
+		if req.Description != opts.Description {
+			t.Errorf("expected the description %q, but got %+v", opts.Description, req)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrPoolClosed is returned when using a Pool after it has been closed.
+var ErrPoolClosed = errors.New("github.com/cognitive-i/gpg/agent: pool closed")
+
+// Pool manages up to a fixed number of connections to the same gpg-agent, so
+// it can be used concurrently. Each operation runs on a connection of its
+// own, which is dialed on demand with the arguments given to NewPool.
+// Connections that broke down are closed rather than reused.
+//
+// The Keys obtained from a Pool take a connection from it for each
+// operation, so unlike those of a Conn they don't serialise their callers.
+// A PassphraseProvider set with WithPinentryLoopback must be safe for
+// concurrent use.
+type Pool struct {
+	filename string
+	options  []string
+	opts     []DialOption
+	size     int
+
+	// slots holds a token for each connection in use.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewPool returns a Pool of at most size connections, each dialed like Dial
+// does with filename, options and opts. One connection is dialed right away
+// to check that the agent can be reached.
+func NewPool(size int, filename string, options []string, opts ...DialOption) (*Pool, error) {
+	return NewPoolContext(context.Background(), size, filename, options, opts...)
+}
+
+// NewPoolContext is like NewPool, but gives up dialing the first connection
+// when ctx is done.
+func NewPoolContext(ctx context.Context, size int, filename string, options []string, opts ...DialOption) (*Pool, error) {
+	if size < 1 {
+		return nil, errors.New("github.com/cognitive-i/gpg/agent: pool size must be positive")
+	}
+
+	p := &Pool{
+		filename: filename,
+		options:  options,
+		opts:     opts,
+		size:     size,
+		slots:    make(chan struct{}, size),
+	}
+
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.Put(conn)
+
+	return p, nil
+}
+
+// Size returns the maximum number of connections of the pool.
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Get returns a connection of the pool for the exclusive use of the caller,
+// waiting for one to be returned if all of them are in use. It must be given
+// back with Put.
+func (p *Pool) Get() (*Conn, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext is like Get, but gives up waiting for or dialing a connection
+// when ctx is done.
+func (p *Pool) GetContext(ctx context.Context) (*Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+
+	if n := len(p.idle); n > 0 {
+		conn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := DialContext(ctx, p.filename, p.options, p.opts...)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Put gives a connection obtained from Get back to the pool. It is closed
+// instead if it broke down, or if the pool has been closed.
+func (p *Pool) Put(conn *Conn) {
+	conn.mu.Lock()
+	broken := conn.broken()
+	conn.mu.Unlock()
+
+	p.mu.Lock()
+	if broken || p.closed {
+		p.mu.Unlock()
+		_ = conn.Close()
+	} else {
+		p.idle = append(p.idle, conn)
+		p.mu.Unlock()
+	}
+
+	<-p.slots
+}
+
+// Close closes the idle connections of the pool. Connections in use are
+// closed when they are given back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	var err error
+	for _, conn := range idle {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Ping checks that gpg-agent is alive and answers commands, on a connection
+// of the pool.
+func (p *Pool) Ping() error {
+	return p.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but gives up when ctx is done.
+func (p *Pool) PingContext(ctx context.Context) error {
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Put(conn)
+
+	return conn.PingContext(ctx)
+}
+
+// Key returns the key information for the key with the specified keygrip.
+// The key runs its operations on the connections of the pool.
+func (p *Pool) Key(keygrip string) (Key, error) {
+	return p.KeyContext(context.Background(), keygrip)
+}
+
+// KeyContext is like Key, but aborts the operation when ctx is done.
+func (p *Pool) KeyContext(ctx context.Context, keygrip string) (Key, error) {
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return Key{}, err
+	}
+	defer p.Put(conn)
+
+	key, err := conn.KeyContext(ctx, keygrip)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key.conn, key.pool = nil, p
+	return key, nil
+}
+
+// Keys returns a list of available keys. The keys run their operations on
+// the connections of the pool.
+func (p *Pool) Keys() ([]Key, error) {
+	return p.KeysContext(context.Background())
+}
+
+// KeysContext is like Keys, but aborts the operation when ctx is done.
+func (p *Pool) KeysContext(ctx context.Context) ([]Key, error) {
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(conn)
+
+	keys, err := conn.KeysContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		keys[i].conn, keys[i].pool = nil, p
+	}
+
+	return keys, nil
+}
+
+// acquire returns the connection to run an operation with this key on,
+// locked for the caller, with a sequence of commands begun on it. release
+// ends the sequence and unlocks the connection again, giving it back to the
+// pool the key was obtained from, if any.
+func (key *Key) acquire(ctx context.Context) (conn *Conn, release func(), err error) {
+	unlock := func() {}
+	if key.pool == nil {
+		conn = key.conn
+		conn.mu.Lock()
+		unlock = conn.mu.Unlock
+	} else {
+		if conn, err = key.pool.GetContext(ctx); err != nil {
+			return nil, nil, err
+		}
+
+		conn.mu.Lock()
+		unlock = func() {
+			conn.mu.Unlock()
+			key.pool.Put(conn)
+		}
+	}
+
+	end, err := conn.begin(ctx)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	return conn, func() {
+		end()
+		unlock()
+	}, nil
+}
@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+func TestPool(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	p, err := NewPool(4, s.Socket, nil)
+	if err != nil {
+		t.Fatalf("NewPool(): %s", err)
+	}
+	defer p.Close()
+
+	keys, err := p.Keys()
+	if err != nil {
+		t.Fatalf("Keys(): %s", err)
+	}
+
+	if len(keys) != 1 || keys[0].Keygrip != keygrip {
+		t.Fatalf("expected key %s, but got %v", keygrip, keys)
+	}
+
+	// Slow down signing, so the signatures can only be done in time in
+	// parallel.
+	s.Inject("PKSIGN", agenttest.Fault{Delay: 200 * time.Millisecond})
+
+	key := keys[0]
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			digest := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+			sig, err := key.Sign(rand.Reader, digest[:], nil)
+			if err == nil {
+				err = verifyECDSA(&priv.PublicKey, digest[:], sig)
+			}
+
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Sign(): %s", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed >= 1600*time.Millisecond {
+		t.Errorf("signing took %s, the pool doesn't seem to sign in parallel", elapsed)
+	}
+}
+
+func TestPoolEvictsBrokenConnections(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	p, err := NewPool(1, s.Socket, nil)
+	if err != nil {
+		t.Fatalf("NewPool(): %s", err)
+	}
+	defer p.Close()
+
+	key, err := p.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	digest := sha256.Sum256([]byte("Hello World"))
+
+	s.Inject("PKSIGN", agenttest.Fault{Hangup: true})
+	if _, err := key.Sign(rand.Reader, digest[:], nil); err == nil {
+		t.Fatal("expected Sign() to fail when gpg-agent hangs up, but it didn't")
+	}
+	s.ClearFaults()
+
+	sig, err := key.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if err := verifyECDSA(&priv.PublicKey, digest[:], sig); err != nil {
+		t.Errorf("verifyECDSA(): %s", err)
+	}
+}
+
+func TestPoolGetContext(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	p, err := NewPool(1, s.Socket, nil)
+	if err != nil {
+		t.Fatalf("NewPool(): %s", err)
+	}
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get(): %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := p.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected GetContext() to time out while the pool is exhausted, but got %v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close(): %s", err)
+	}
+
+	p.Put(conn)
+	if _, err := conn.Version(); err == nil {
+		t.Errorf("expected the connection to be closed after the pool, but it wasn't")
+	}
+
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed, but got %v", err)
+	}
+}
+
+func TestSignBatchWithPool(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	p, err := NewPool(3, s.Socket, nil)
+	if err != nil {
+		t.Fatalf("NewPool(): %s", err)
+	}
+	defer p.Close()
+
+	key, err := p.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	var digests [][]byte
+	for i := 0; i < 10; i++ {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+		digests = append(digests, digest[:])
+	}
+
+	sigs, err := key.SignBatch(digests, nil)
+	if err != nil {
+		t.Fatalf("SignBatch(): %s", err)
+	}
+
+	for i, digest := range digests {
+		if err := verifyECDSA(&priv.PublicKey, digest, sigs[i]); err != nil {
+			t.Errorf("digest %d: %s", i, err)
+		}
+	}
+}
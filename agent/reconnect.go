@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// idempotentCommands are the commands which may be sent again after the
+// connection broke down before gpg-agent answered them.
+var idempotentCommands = map[string]bool{
+	"NOP":     true,
+	"GETINFO": true,
+	"KEYINFO": true,
+	"READKEY": true,
+}
+
+// ready makes sure the connection is usable for the next command. If it
+// broke down, it dials gpg-agent again when WithReconnect was given to Dial,
+// unless a sequence of commands is in progress, and returns the error it
+// broke down with otherwise.
+func (conn *Conn) ready(ctx context.Context) error {
+	if conn.err == nil {
+		return nil
+	}
+
+	if conn.closed || conn.sequences > 0 || conn.cfg == nil || !conn.cfg.reconnect {
+		return conn.err
+	}
+
+	_ = conn.c.Close()
+	return conn.connect(ctx)
+}
+
+// retryable reports whether the command line may be sent again on a new
+// connection, after it failed because the connection broke down before any
+// response was read.
+func (conn *Conn) retryable(r *reply, line string) bool {
+	if !conn.broken() || conn.closed || conn.sequences > 0 || r.received || r.ctx.Err() != nil {
+		return false
+	}
+
+	if conn.cfg == nil || !conn.cfg.reconnect {
+		return false
+	}
+
+	fields := strings.Fields(line)
+	return len(fields) > 0 && idempotentCommands[strings.ToUpper(fields[0])]
+}
+
+// begin starts a sequence of commands relying on the session state set up
+// by each other, such as the key selected by SETKEY. The connection is dialed
+// again first if needed, but not until end is called: the remaining commands
+// fail with the error it broke down with rather than run on a new session
+// lacking that state. Sequences may be nested. The caller must hold conn.mu.
+func (conn *Conn) begin(ctx context.Context) (end func(), err error) {
+	if err := conn.ready(ctx); err != nil {
+		return nil, err
+	}
+
+	conn.sequences++
+	return func() { conn.sequences-- }, nil
+}
+
+// Ping checks that gpg-agent is alive and answers commands. With
+// WithReconnect, it dials gpg-agent again if needed.
+func (conn *Conn) Ping() error {
+	return conn.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but gives up when ctx is done.
+func (conn *Conn) PingContext(ctx context.Context) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.RawContext(ctx, nil, "NOP")
+}
+
+// PID returns the process ID of gpg-agent, which changes when gpg-agent is
+// restarted.
+func (conn *Conn) PID() (int, error) {
+	return conn.PIDContext(context.Background())
+}
+
+// PIDContext is like PID, but aborts the operation when ctx is done.
+func (conn *Conn) PIDContext(ctx context.Context) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	pid, err := conn.RawDataContext(ctx, nil, "GETINFO pid")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(pid))
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+func TestReconnect(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv, Protected: true, Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	p := &passphraseRecorder{passphrases: []string{"secret"}}
+	c, err := Dial(s.Socket, nil, WithPinentryLoopback(p), WithReconnect())
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	// KEYINFO is retried on a new connection.
+	s.Disconnect()
+	if _, err := c.Key(keygrip); err != nil {
+		t.Fatalf("Key(%s) after disconnecting: %s", keygrip, err)
+	}
+
+	// The new connection uses the loopback pinentry as well.
+	s.Disconnect()
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Ping() after disconnecting: %s", err)
+	}
+
+	sig, err := key.Sign(rand.Reader, []byte("Hello World"), nil)
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), []byte("Hello World"), sig) {
+		t.Errorf("invalid signature")
+	}
+
+	if len(p.requests) != 1 {
+		t.Errorf("expected the passphrase to be asked for once, but it was asked for %d times", len(p.requests))
+	}
+}
+
+func TestReconnectDoesNotRetryPKSIGN(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil, WithReconnect())
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	s.Inject("PKSIGN", agenttest.Fault{Hangup: true})
+	if _, err := key.Sign(rand.Reader, []byte("Hello World"), nil); err == nil {
+		t.Fatal("expected Sign() to fail when gpg-agent hangs up, but it didn't")
+	}
+	s.ClearFaults()
+
+	if _, err := key.Sign(rand.Reader, []byte("Hello World"), nil); err != nil {
+		t.Fatalf("Sign() after reconnecting: %s", err)
+	}
+}
+
+func TestReconnectDuringOperation(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	keygrip, err := s.AddKey(agenttest.Key{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("AddKey(): %s", err)
+	}
+
+	c, err := Dial(s.Socket, nil, WithReconnect())
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	key, err := c.Key(keygrip)
+	if err != nil {
+		t.Fatalf("Key(%s): %s", keygrip, err)
+	}
+
+	// Signing with Ed25519 asks whether SETHASH takes --inquire between
+	// SETKEY and PKSIGN. gpg-agent goes away while it's asked, which must
+	// not move the rest of the operation to a new session lacking the key.
+	s.Inject("GETINFO", agenttest.Fault{Delay: 200 * time.Millisecond})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.Disconnect()
+	}()
+
+	_, err = key.Sign(rand.Reader, []byte("Hello World"), nil)
+	if err == nil {
+		t.Fatal("expected Sign() to fail when gpg-agent goes away, but it didn't")
+	}
+
+	if _, ok := err.(Error); ok {
+		t.Fatalf("expected Sign() to fail with the connection error, but got %v", err)
+	}
+	s.ClearFaults()
+
+	sig, err := key.Sign(rand.Reader, []byte("Hello World"), nil)
+	if err != nil {
+		t.Fatalf("Sign() after reconnecting: %s", err)
+	}
+
+	if !ed25519.Verify(priv.Public().(ed25519.PublicKey), []byte("Hello World"), sig) {
+		t.Errorf("invalid signature")
+	}
+}
+
+func TestWithoutReconnect(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	c, err := Dial(s.Socket, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	s.Disconnect()
+	if err := c.Ping(); err == nil {
+		t.Fatal("expected Ping() to fail after disconnecting, but it didn't")
+	}
+
+	if err := c.Ping(); err == nil {
+		t.Fatal("expected the connection to stay broken, but Ping() succeeded")
+	}
+}
+
+func TestPID(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	c, err := Dial(s.Socket, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	defer c.Close()
+
+	pid, err := c.PID()
+	if err != nil {
+		t.Fatalf("PID(): %s", err)
+	}
+
+	// The fake gpg-agent runs in this process.
+	if pid != os.Getpid() {
+		t.Errorf("expected pid %d, but got %d", os.Getpid(), pid)
+	}
+}
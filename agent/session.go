@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SessionOptions describe the environment gpg-agent shows pinentry in, so it
+// appears on the same terminal or desktop session as the client. Empty
+// fields are not sent.
+type SessionOptions struct {
+	// Display is the X11 display, as in the DISPLAY environment variable.
+	Display string
+
+	// TTYName is the terminal, such as /dev/pts/1, and TTYType its type, as
+	// in the TERM environment variable.
+	TTYName string
+	TTYType string
+
+	// LCCType and LCMessages are the locales of the character set and the
+	// messages of pinentry.
+	LCCType    string
+	LCMessages string
+
+	// Env holds further environment variables for pinentry, in the form
+	// NAME=VALUE, or NAME to unset one.
+	Env []string
+
+	// UpdateStartupTTY makes gpg-agent use this environment for the
+	// pinentry of requests which don't come with their own, such as those
+	// of ssh-agent clients. This affects all clients of gpg-agent.
+	UpdateStartupTTY bool
+}
+
+// sessionEnv lists the environment variables gpg passes on to gpg-agent
+// besides the ones with a dedicated option.
+var sessionEnv = []string{
+	"XAUTHORITY",
+	"XMODIFIERS",
+	"WAYLAND_DISPLAY",
+	"XDG_SESSION_TYPE",
+	"QT_QPA_PLATFORM",
+	"GTK_IM_MODULE",
+	"DBUS_SESSION_BUS_ADDRESS",
+	"QT_IM_MODULE",
+	"INSIDE_EMACS",
+}
+
+// InheritSessionOptions returns the SessionOptions of the current process,
+// taken from its environment the way gpg does it. The terminal is taken from
+// GPG_TTY, or else the terminal of the standard input, if it can be found.
+func InheritSessionOptions() *SessionOptions {
+	opts := &SessionOptions{
+		Display:    os.Getenv("DISPLAY"),
+		TTYName:    os.Getenv("GPG_TTY"),
+		TTYType:    os.Getenv("TERM"),
+		LCCType:    locale("LC_CTYPE"),
+		LCMessages: locale("LC_MESSAGES"),
+	}
+
+	if opts.TTYName == "" {
+		opts.TTYName = stdinTTY()
+	}
+
+	for _, name := range sessionEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			opts.Env = append(opts.Env, name+"="+value)
+		}
+	}
+
+	return opts
+}
+
+// locale returns the locale of the specified category, resolved like
+// setlocale does it.
+func locale(category string) string {
+	for _, name := range []string{"LC_ALL", category, "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// stdinTTY returns the name of the terminal of the standard input, or "" if
+// it's not a terminal or its name can't be found.
+func stdinTTY() string {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return ""
+	}
+
+	name, err := os.Readlink("/proc/self/fd/0")
+	if err != nil || !strings.HasPrefix(name, "/dev/") || name == os.DevNull {
+		return ""
+	}
+
+	return filepath.Clean(name)
+}
+
+// options returns the Assuan options setting opts, in the order gpg sends
+// them.
+func (opts *SessionOptions) options() ([]string, error) {
+	var options []string
+	for _, opt := range []struct{ name, value string }{
+		{"display", opts.Display},
+		{"ttyname", opts.TTYName},
+		{"ttytype", opts.TTYType},
+		{"lc-ctype", opts.LCCType},
+		{"lc-messages", opts.LCMessages},
+	} {
+		if opt.value != "" {
+			options = append(options, opt.name+"="+opt.value)
+		}
+	}
+
+	for _, env := range opts.Env {
+		if env == "" || env[0] == '=' {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: invalid session environment variable " + env)
+		}
+
+		options = append(options, "putenv="+env)
+	}
+
+	for _, option := range options {
+		if strings.IndexFunc(option, isControl) >= 0 {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: session options contain control characters")
+		}
+	}
+
+	return options, nil
+}
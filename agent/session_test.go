@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cognitive-i/gpg/agent/agenttest"
+)
+
+// setenv sets the environment variables in env, where an empty value unsets
+// one, and returns a function restoring them.
+func setenv(env map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range env {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+
+	return func() {
+		for name, value := range saved {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func TestInheritSessionOptions(t *testing.T) {
+	env := map[string]string{
+		"DISPLAY":         ":1",
+		"GPG_TTY":         "/dev/pts/3",
+		"TERM":            "xterm-256color",
+		"LC_ALL":          "",
+		"LC_CTYPE":        "de_DE.UTF-8",
+		"LC_MESSAGES":     "",
+		"LANG":            "en_US.UTF-8",
+		"WAYLAND_DISPLAY": "wayland-0",
+	}
+	for _, name := range sessionEnv {
+		if _, ok := env[name]; !ok {
+			env[name] = ""
+		}
+	}
+	defer setenv(env)()
+
+	expected := &SessionOptions{
+		Display:    ":1",
+		TTYName:    "/dev/pts/3",
+		TTYType:    "xterm-256color",
+		LCCType:    "de_DE.UTF-8",
+		LCMessages: "en_US.UTF-8",
+		Env:        []string{"WAYLAND_DISPLAY=wayland-0"},
+	}
+	if opts := InheritSessionOptions(); !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, opts)
+	}
+
+	defer setenv(map[string]string{"LC_ALL": "C"})()
+	if opts := InheritSessionOptions(); opts.LCCType != "C" || opts.LCMessages != "C" {
+		t.Errorf("expected LC_ALL to take precedence, but got %+v", opts)
+	}
+}
+
+func TestDialSessionOptions(t *testing.T) {
+	s, err := agenttest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer(): %s", err)
+	}
+	defer s.Close()
+
+	opts := &SessionOptions{
+		Display:          ":1",
+		TTYName:          "/dev/pts/3",
+		TTYType:          "xterm",
+		LCCType:          "C.UTF-8",
+		Env:              []string{"WAYLAND_DISPLAY=wayland-0", "XAUTHORITY"},
+		UpdateStartupTTY: true,
+	}
+
+	c, err := Dial(s.Socket, []string{"ttytype=screen"}, WithSessionOptions(opts))
+	if err != nil {
+		t.Fatalf("Dial(): %s", err)
+	}
+	c.Close()
+
+	expected := map[string]string{
+		"DISPLAY":         ":1",
+		"GPG_TTY":         "/dev/pts/3",
+		"TERM":            "screen",
+		"LC_CTYPE":        "C.UTF-8",
+		"WAYLAND_DISPLAY": "wayland-0",
+	}
+	if env := s.StartupEnv(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected the startup environment %v, but got %v", expected, env)
+	}
+
+	for _, opts := range []*SessionOptions{
+		{Display: ":1\nBYE"},
+		{Env: []string{"=foo"}},
+	} {
+		if c, err := Dial(s.Socket, nil, WithSessionOptions(opts)); err == nil {
+			c.Close()
+			t.Errorf("expected %+v to be rejected", opts)
+		}
+	}
+}
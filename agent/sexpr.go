@@ -1,13 +1,21 @@
 package agent
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"encoding/asn1"
 	"errors"
 	"fmt"
 	"math/big"
 
 	"github.com/abesto/sexp"
+	"github.com/cognitive-i/gpg"
+	"github.com/cognitive-i/gpg/internal/brainpool"
 )
 
 // These errors may be returned from the functions related to s-expression
@@ -15,6 +23,7 @@ import (
 var (
 	ErrUnknownFormat = errors.New("s-expression is in unknown format")
 	ErrNotPublicKey  = errors.New("s-expression is not a public key")
+	ErrNotPrivateKey = errors.New("s-expression is not a private key")
 	ErrNotSignature  = errors.New("s-expression is not a signature")
 )
 
@@ -41,9 +50,43 @@ func decodePlainText(data []byte) ([]byte, error) {
 	return value, nil
 }
 
+// decodeAlgorithm decodes an (algo(name value)...) list, as used in keys and
+// signatures, into the name of the algorithm and its parameters. Parameters
+// that are not a simple name and value pair are skipped.
+func decodeAlgorithm(exp interface{}) (string, map[string][]byte, error) {
+	l, ok := exp.([]interface{})
+	if !ok || len(l) == 0 {
+		return "", nil, ErrUnknownFormat
+	}
+
+	algo, ok := l[0].([]byte)
+	if !ok {
+		return "", nil, ErrUnknownFormat
+	}
+
+	params := map[string][]byte{}
+	for _, p := range l[1:] {
+		pl, ok := p.([]interface{})
+		if !ok || len(pl) != 2 {
+			continue
+		}
+
+		name, ok1 := pl[0].([]byte)
+		value, ok2 := pl[1].([]byte)
+		if ok1 && ok2 {
+			params[string(name)] = value
+		}
+	}
+
+	return string(algo), params, nil
+}
+
 // (public-key(rsa(n%n)(e%e))(comment))
-func decodeRSAPublicKey(data string) (crypto.PublicKey, error) {
-	exp, err := sexp.Unmarshal([]byte(data))
+// (public-key(ecc(curve%s)(flags%s)(q%q))(comment))
+// (public-key(dsa(p%m)(q%m)(g%m)(y%m))(comment))
+// (public-key(elg(p%m)(g%m)(y%m))(comment))
+func decodePublicKey(data []byte) (crypto.PublicKey, error) {
+	exp, err := sexp.Unmarshal(data)
 	if err != nil {
 		return nil, err
 	}
@@ -56,114 +99,224 @@ func decodeRSAPublicKey(data string) (crypto.PublicKey, error) {
 		return nil, ErrNotPublicKey
 	}
 
-	algol, ok := exp[1].([]interface{})
-	if !ok {
-		return nil, ErrUnknownFormat
-	}
-	if len(algol) != 3 {
-		return nil, ErrUnknownFormat
-	}
-
-	algo, ok := algol[0].([]byte)
-	if !ok {
-		return nil, ErrUnknownFormat
+	algo, params, err := decodeAlgorithm(exp[1])
+	if err != nil {
+		return nil, err
 	}
 
-	switch string(algo) {
+	switch algo {
 	case "rsa":
-		nl, ok := algol[1].([]interface{})
-		if !ok {
+		n, ok1 := params["n"]
+		e, ok2 := params["e"]
+		if !ok1 || !ok2 {
 			return nil, ErrUnknownFormat
 		}
 
-		el, ok := algol[2].([]interface{})
-		if !ok {
+		return &rsa.PublicKey{
+			N: (&big.Int{}).SetBytes(n),
+			E: int((&big.Int{}).SetBytes(e).Int64()),
+		}, nil
+
+	case "ecc":
+		return decodeECCPublicKey(params)
+
+	case "dsa":
+		p, ok1 := params["p"]
+		q, ok2 := params["q"]
+		g, ok3 := params["g"]
+		y, ok4 := params["y"]
+		if !ok1 || !ok2 || !ok3 || !ok4 {
 			return nil, ErrUnknownFormat
 		}
 
-		if len(nl) != 2 || len(el) != 2 {
+		return &dsa.PublicKey{
+			Parameters: dsa.Parameters{
+				P: (&big.Int{}).SetBytes(p),
+				Q: (&big.Int{}).SetBytes(q),
+				G: (&big.Int{}).SetBytes(g),
+			},
+			Y: (&big.Int{}).SetBytes(y),
+		}, nil
+
+	case "elg":
+		p, ok1 := params["p"]
+		g, ok2 := params["g"]
+		y, ok3 := params["y"]
+		if !ok1 || !ok2 || !ok3 {
 			return nil, ErrUnknownFormat
 		}
 
-		var name []byte
-		if name, ok = nl[0].([]byte); !ok || string(name) != "n" {
-			return nil, ErrUnknownFormat
+		return &gpg.ElGamalPublicKey{
+			P: (&big.Int{}).SetBytes(p),
+			G: (&big.Int{}).SetBytes(g),
+			Y: (&big.Int{}).SetBytes(y),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%s: unknown algorithm", algo)
+	}
+}
+
+func decodeECCPublicKey(params map[string][]byte) (crypto.PublicKey, error) {
+	q, ok := params["q"]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+
+	curve := string(params["curve"])
+	switch curve {
+	case "Ed25519", "ed25519", "1.3.6.1.4.1.11591.15.1":
+		// The point may carry the 0x40 prefix libgcrypt uses for native
+		// compressed points.
+		if len(q) == ed25519.PublicKeySize+1 && q[0] == 0x40 {
+			q = q[1:]
 		}
 
-		n, ok := nl[1].([]byte)
-		if !ok {
+		if len(q) != ed25519.PublicKeySize {
 			return nil, ErrUnknownFormat
 		}
 
-		if name, ok = el[0].([]byte); !ok || string(name) != "e" {
-			return nil, ErrUnknownFormat
+		return ed25519.PublicKey(q), nil
+
+	case "Curve25519", "cv25519", "1.3.6.1.4.1.3029.1.5.1":
+		if len(q) == x25519Size+1 && q[0] == 0x40 {
+			q = q[1:]
 		}
 
-		e, ok := el[1].([]byte)
-		if !ok {
+		if len(q) != x25519Size {
 			return nil, ErrUnknownFormat
 		}
 
-		return &rsa.PublicKey{
-			N: (&big.Int{}).SetBytes(n),
-			E: int((&big.Int{}).SetBytes(e).Int64()),
-		}, nil
+		return X25519PublicKey(q), nil
+	}
 
-	default:
-		return nil, fmt.Errorf("%s: unknown algorithm", string(algo))
+	newCurve, ok := ecdsaCurves[curve]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown curve", curve)
 	}
+
+	c := newCurve()
+	x, y := elliptic.Unmarshal(c, q)
+	if x == nil {
+		return nil, ErrUnknownFormat
+	}
+
+	return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
 }
 
-// (sig-val(rsa(s%s)))
-func decodeRSASignature(data []byte) ([]byte, error) {
+// ecdsaCurves maps the names and OIDs libgcrypt uses for Weierstrass curves
+// to their Go implementation.
+var ecdsaCurves = map[string]func() elliptic.Curve{
+	"NIST P-256":          elliptic.P256,
+	"nistp256":            elliptic.P256,
+	"prime256v1":          elliptic.P256,
+	"secp256r1":           elliptic.P256,
+	"1.2.840.10045.3.1.7": elliptic.P256,
+
+	"NIST P-384":   elliptic.P384,
+	"nistp384":     elliptic.P384,
+	"secp384r1":    elliptic.P384,
+	"1.3.132.0.34": elliptic.P384,
+
+	"NIST P-521":   elliptic.P521,
+	"nistp521":     elliptic.P521,
+	"secp521r1":    elliptic.P521,
+	"1.3.132.0.35": elliptic.P521,
+
+	"brainpoolP256r1":       brainpool.P256r1,
+	"1.3.36.3.3.2.8.1.1.7":  brainpool.P256r1,
+	"brainpoolP384r1":       brainpool.P384r1,
+	"1.3.36.3.3.2.8.1.1.11": brainpool.P384r1,
+	"brainpoolP512r1":       brainpool.P512r1,
+	"1.3.36.3.3.2.8.1.1.13": brainpool.P512r1,
+}
+
+// (sig-val(algo(name value)...))
+func decodeSignature(data []byte) (string, map[string][]byte, error) {
 	exp, err := sexp.Unmarshal(data)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	if len(exp) != 2 {
-		return nil, ErrUnknownFormat
+		return "", nil, ErrUnknownFormat
 	}
 
 	name, ok := exp[0].([]byte)
 	if !ok || string(name) != "sig-val" {
-		return nil, ErrNotSignature
+		return "", nil, ErrNotSignature
 	}
 
-	algol, ok := exp[1].([]interface{})
+	return decodeAlgorithm(exp[1])
+}
+
+// (sig-val(rsa(s%s)))
+func decodeRSASignature(data []byte) ([]byte, error) {
+	algo, params, err := decodeSignature(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if algo != "rsa" {
+		return nil, fmt.Errorf("%s: unknown algorithm", algo)
+	}
+
+	signature, ok := params["s"]
 	if !ok {
 		return nil, ErrUnknownFormat
 	}
-	if len(algol) != 2 {
-		return nil, ErrUnknownFormat
+
+	return signature, nil
+}
+
+// (sig-val(eddsa(r%r)(s%s)))
+func decodeEdDSASignature(data []byte) ([]byte, error) {
+	algo, params, err := decodeSignature(data)
+	if err != nil {
+		return nil, err
 	}
 
-	algo, ok := algol[0].([]byte)
-	if !ok {
+	if algo != "eddsa" {
+		return nil, fmt.Errorf("%s: unknown algorithm", algo)
+	}
+
+	r, ok1 := params["r"]
+	s, ok2 := params["s"]
+	if !ok1 || !ok2 || len(r) > ed25519.SignatureSize/2 || len(s) > ed25519.SignatureSize/2 {
 		return nil, ErrUnknownFormat
 	}
 
-	switch string(algo) {
-	case "rsa":
-		l, ok := algol[1].([]interface{})
-		if !ok || len(l) != 2 {
-			return nil, ErrUnknownFormat
-		}
+	// Leading zero bytes may have been stripped from r and s.
+	signature := make([]byte, ed25519.SignatureSize)
+	copy(signature[ed25519.SignatureSize/2-len(r):], r)
+	copy(signature[ed25519.SignatureSize-len(s):], s)
 
-		var name []byte
-		if name, ok = l[0].([]byte); !ok || string(name) != "s" {
-			return nil, ErrUnknownFormat
-		}
+	return signature, nil
+}
 
-		signature, ok := l[1].([]byte)
-		if !ok {
-			return nil, ErrUnknownFormat
-		}
+// (sig-val(ecdsa(r%r)(s%s))), returned as the ASN.1 DER encoding used by
+// crypto/ecdsa.
+func decodeECDSASignature(data []byte) ([]byte, error) {
+	algo, params, err := decodeSignature(data)
+	if err != nil {
+		return nil, err
+	}
 
-		return signature, nil
+	if algo != "ecdsa" {
+		return nil, fmt.Errorf("%s: unknown algorithm", algo)
+	}
 
-	default:
-		return nil, fmt.Errorf("%s: unknown algorithm", string(algo))
+	r, ok1 := params["r"]
+	s, ok2 := params["s"]
+	if !ok1 || !ok2 {
+		return nil, ErrUnknownFormat
 	}
+
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: (&big.Int{}).SetBytes(r),
+		S: (&big.Int{}).SetBytes(s),
+	})
 }
 
 // (enc-val(rsa(a%m)))
@@ -181,3 +334,191 @@ func encodeRSACipherText(cyphertext []byte) ([]byte, error) {
 
 	return sexp.Marshal(sexpText, true)
 }
+
+// (enc-val(ecdh(e%e)))
+func encodeECDHCipherText(ephemeral []byte) ([]byte, error) {
+	sexpText := []interface{}{
+		[]byte("enc-val"),
+		[]interface{}{
+			[]byte("ecdh"),
+			[]interface{}{
+				[]byte("e"),
+				ephemeral,
+			},
+		},
+	}
+
+	return sexp.Marshal(sexpText, true)
+}
+
+// (private-key(rsa(n%m)(e%m)(d%m)(p%m)(q%m)(u%m)))
+// (private-key(ecc(curve%s)(flags eddsa)(q%q)(d%d)))
+// (private-key(ecc(curve%s)(q%q)(d%d)))
+func encodePrivateKey(priv crypto.PrivateKey) ([]byte, error) {
+	var params []interface{}
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(priv.Primes) != 2 {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: RSA keys with more than two primes are not supported")
+		}
+
+		// libgcrypt expects p < q, with u = p⁻¹ mod q.
+		p, q := priv.Primes[0], priv.Primes[1]
+		if p.Cmp(q) > 0 {
+			p, q = q, p
+		}
+		u := new(big.Int).ModInverse(p, q)
+
+		params = []interface{}{
+			[]byte("rsa"),
+			[]interface{}{[]byte("n"), mpi(priv.N)},
+			[]interface{}{[]byte("e"), mpi(big.NewInt(int64(priv.E)))},
+			[]interface{}{[]byte("d"), mpi(priv.D)},
+			[]interface{}{[]byte("p"), mpi(p)},
+			[]interface{}{[]byte("q"), mpi(q)},
+			[]interface{}{[]byte("u"), mpi(u)},
+		}
+
+	case ed25519.PrivateKey:
+		if len(priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("github.com/cognitive-i/gpg/agent: invalid ed25519 private key")
+		}
+
+		params = []interface{}{
+			[]byte("ecc"),
+			[]interface{}{[]byte("curve"), []byte("Ed25519")},
+			[]interface{}{[]byte("flags"), []byte("eddsa")},
+			[]interface{}{[]byte("q"), append([]byte{0x40}, priv.Public().(ed25519.PublicKey)...)},
+			[]interface{}{[]byte("d"), []byte(priv.Seed())},
+		}
+
+	case *ecdsa.PrivateKey:
+		name, err := curveName(priv.Curve)
+		if err != nil {
+			return nil, err
+		}
+
+		params = []interface{}{
+			[]byte("ecc"),
+			[]interface{}{[]byte("curve"), []byte(name)},
+			[]interface{}{[]byte("q"), elliptic.Marshal(priv.Curve, priv.X, priv.Y)},
+			[]interface{}{[]byte("d"), mpi(priv.D)},
+		}
+
+	default:
+		return nil, fmt.Errorf("github.com/cognitive-i/gpg/agent: unsupported private key type %T", priv)
+	}
+
+	return sexp.Marshal([]interface{}{[]byte("private-key"), params}, true)
+}
+
+// curveName returns the name libgcrypt uses for a NIST or brainpool curve.
+func curveName(curve elliptic.Curve) (string, error) {
+	name := curve.Params().Name
+	switch name {
+	case "P-256", "P-384", "P-521":
+		return "NIST " + name, nil
+	case "brainpoolP256r1", "brainpoolP384r1", "brainpoolP512r1":
+		return name, nil
+	}
+
+	return "", fmt.Errorf("%s: unknown curve", name)
+}
+
+// mpi encodes v the way libgcrypt prints unsigned integers, with a leading
+// zero byte if the high bit is set.
+func mpi(v *big.Int) []byte {
+	b := v.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return append([]byte{0}, b...)
+	}
+
+	return b
+}
+
+// (private-key(rsa(n%m)(e%m)(d%m)(p%m)(q%m)(u%m)))
+// (private-key(ecc(curve%s)(flags%s)(q%q)(d%d)))
+func decodePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	exp, err := sexp.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(exp) < 2 {
+		return nil, ErrUnknownFormat
+	}
+
+	name, ok := exp[0].([]byte)
+	if !ok || string(name) != "private-key" {
+		return nil, ErrNotPrivateKey
+	}
+
+	algo, params, err := decodeAlgorithm(exp[1])
+	if err != nil {
+		return nil, err
+	}
+
+	num := func(name string) *big.Int {
+		return (&big.Int{}).SetBytes(params[name])
+	}
+
+	switch algo {
+	case "rsa":
+		for _, name := range []string{"n", "e", "d", "p", "q"} {
+			if _, ok := params[name]; !ok {
+				return nil, ErrUnknownFormat
+			}
+		}
+
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: num("n"), E: int(num("e").Int64())},
+			D:         num("d"),
+			Primes:    []*big.Int{num("p"), num("q")},
+		}
+		if err := priv.Validate(); err != nil {
+			return nil, err
+		}
+		priv.Precompute()
+
+		return priv, nil
+
+	case "ecc":
+		d, ok := params["d"]
+		if !ok {
+			return nil, ErrUnknownFormat
+		}
+
+		pub, err := decodeECCPublicKey(params)
+		if err != nil {
+			return nil, err
+		}
+
+		switch pub := pub.(type) {
+		case ed25519.PublicKey:
+			if len(d) > ed25519.SeedSize {
+				return nil, ErrUnknownFormat
+			}
+
+			seed := make([]byte, ed25519.SeedSize)
+			copy(seed[ed25519.SeedSize-len(d):], d)
+			priv := ed25519.NewKeyFromSeed(seed)
+			if !bytes.Equal(priv.Public().(ed25519.PublicKey), pub) {
+				return nil, ErrUnknownFormat
+			}
+
+			return priv, nil
+
+		case *ecdsa.PublicKey:
+			priv := &ecdsa.PrivateKey{PublicKey: *pub, D: num("d")}
+			if x, y := pub.Curve.ScalarBaseMult(d); x.Cmp(pub.X) != 0 || y.Cmp(pub.Y) != 0 {
+				return nil, ErrUnknownFormat
+			}
+
+			return priv, nil
+		}
+
+		return nil, fmt.Errorf("%s: unsupported curve", params["curve"])
+
+	default:
+		return nil, fmt.Errorf("%s: unknown algorithm", algo)
+	}
+}
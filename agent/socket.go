@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Socket identifies one of the sockets gpg-agent listens on.
+type Socket int
+
+// These constants define the possible Socket values.
+const (
+	SocketStandard Socket = iota
+	SocketExtra
+	SocketBrowser
+	SocketSSH
+)
+
+// Filename returns the name of the socket within the socket directory.
+func (s Socket) Filename() string {
+	switch s {
+	case SocketExtra:
+		return "S.gpg-agent.extra"
+	case SocketBrowser:
+		return "S.gpg-agent.browser"
+	case SocketSSH:
+		return "S.gpg-agent.ssh"
+	}
+
+	return "S.gpg-agent"
+}
+
+// runDirs lists the directories searched for a per-user runtime directory,
+// in the same order as GnuPG does.
+var runDirs = []string{"/run", "/var/run"}
+
+// zbase32Alphabet is the alphabet of the human-oriented base-32 encoding
+// GnuPG uses to name socket directories.
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// SocketPath returns the path of the specified socket of the gpg-agent that
+// serves homedir, resolved the way GnuPG does it. If homedir is "", the
+// GNUPGHOME environment variable or else ~/.gnupg is used.
+func SocketPath(homedir string, socket Socket) (string, error) {
+	dir, err := socketDir(homedir)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, socket.Filename()), nil
+}
+
+// defaultHomedir returns the home directory GnuPG uses when none is given.
+func defaultHomedir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".gnupg"), nil
+}
+
+// canonicalHomedir makes homedir absolute and strips trailing slashes, but
+// like GnuPG does not clean it any further, as the result is hashed.
+func canonicalHomedir(homedir string) (string, error) {
+	if homedir == "" {
+		homedir = os.Getenv("GNUPGHOME")
+	}
+
+	if homedir == "" {
+		return defaultHomedir()
+	}
+
+	if !filepath.IsAbs(homedir) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+
+		homedir = cwd + string(filepath.Separator) + homedir
+	}
+
+	for len(homedir) > 1 && strings.HasSuffix(homedir, string(filepath.Separator)) {
+		homedir = homedir[:len(homedir)-1]
+	}
+
+	return homedir, nil
+}
+
+// socketDir returns the directory containing the sockets of the gpg-agent
+// serving homedir. Unless the per-user runtime directory is set up properly,
+// that's the homedir itself.
+func socketDir(homedir string) (string, error) {
+	homedir, err := canonicalHomedir(homedir)
+	if err != nil {
+		return "", err
+	}
+
+	defaultDir, err := defaultHomedir()
+	if err != nil {
+		return "", err
+	}
+
+	var base string
+	for _, dir := range runDirs {
+		dir = filepath.Join(dir, "user", fmt.Sprint(os.Getuid()))
+		if isPrivateDir(dir, false) {
+			base = filepath.Join(dir, "gnupg")
+			break
+		}
+	}
+
+	if base == "" || !isPrivateDir(base, true) {
+		return homedir, nil
+	}
+
+	if homedir == defaultDir {
+		return base, nil
+	}
+
+	// Sockets of non-default homedirs live in a sub directory named after
+	// the hash of the homedir, to keep the socket paths short.
+	sum := sha1.Sum([]byte(homedir))
+	sub := filepath.Join(base, "d."+zbase32(sum[:15]))
+	if !isPrivateDir(sub, true) {
+		return homedir, nil
+	}
+
+	return sub, nil
+}
+
+// isPrivateDir reports whether dir is a directory owned by the current user
+// and, if strict is set, not accessible by anyone else. Like GnuPG, only the
+// permissions of the group and others matter.
+func isPrivateDir(dir string, strict bool) bool {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() || !ownedByUser(fi) {
+		return false
+	}
+
+	return !strict || fi.Mode().Perm()&0077 == 0
+}
+
+// zbase32 encodes data in z-base-32, as used by GnuPG. The length of data in
+// bits must be a multiple of 5.
+func zbase32(data []byte) string {
+	var sb strings.Builder
+
+	var acc uint
+	var bits uint
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+
+	return sb.String()
+}
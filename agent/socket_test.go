@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZbase32(t *testing.T) {
+	// Socket directories reported by gpgconf --list-dirs socketdir.
+	tests := map[string]string{
+		"/tmp/gk": "86di1jzzmtspqtsu746wq8ip",
+		"/tmp/gh": "ffabiqijjfckceggnzrykjtw",
+	}
+
+	for homedir, expected := range tests {
+		sum := sha1.Sum([]byte(homedir))
+		if encoded := zbase32(sum[:15]); encoded != expected {
+			t.Errorf("%s: expected %q, but got %q", homedir, expected, encoded)
+		}
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	run, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(run)
+
+	defer func(dirs []string) { runDirs = dirs }(runDirs)
+	runDirs = []string{run}
+
+	homedir := filepath.Join(run, "home")
+
+	// Without a runtime directory, the sockets live in the homedir.
+	filename, err := SocketPath(homedir+"/", SocketExtra)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := filepath.Join(homedir, "S.gpg-agent.extra"); filename != expected {
+		t.Errorf("expected %q, but got %q", expected, filename)
+	}
+
+	// With one, they live in a directory named after the homedir.
+	sum := sha1.Sum([]byte(homedir))
+	socketDir := filepath.Join(run, "user", fmt.Sprint(os.Getuid()), "gnupg", "d."+zbase32(sum[:15]))
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	filename, err = SocketPath(homedir, SocketStandard)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := filepath.Join(socketDir, "S.gpg-agent"); filename != expected {
+		t.Errorf("expected %q, but got %q", expected, filename)
+	}
+
+	// Restricting the permissions of the user further is fine.
+	if err := os.Chmod(socketDir, 0500); err != nil {
+		t.Fatal(err)
+	}
+
+	filename, err = SocketPath(homedir, SocketBrowser)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := filepath.Join(socketDir, "S.gpg-agent.browser"); filename != expected {
+		t.Errorf("expected %q, but got %q", expected, filename)
+	}
+
+	// Unless that directory is accessible by others.
+	if err := os.Chmod(socketDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	filename, err = SocketPath(homedir, SocketSSH)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := filepath.Join(homedir, "S.gpg-agent.ssh"); filename != expected {
+		t.Errorf("expected %q, but got %q", expected, filename)
+	}
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is implemented by all status lines delivered to a StatusFunc.
+// Status lines without a more specific type are delivered as a StatusLine.
+type Status interface {
+	// Raw returns the status line as it was received.
+	Raw() StatusLine
+}
+
+// StatusFunc receives the status lines gpg-agent sends while running a
+// command. It is called while the connection is busy with that command, so
+// it must not use the connection itself and should return quickly.
+type StatusFunc func(Status)
+
+// StatusLine describes a status line in its unparsed form.
+type StatusLine struct {
+	Keyword string
+	Params  string
+}
+
+// Raw implements the Status interface.
+func (s StatusLine) Raw() StatusLine {
+	return s
+}
+
+// ProgressStatus reports the progress of a lengthy operation, such as
+// generating a key.
+type ProgressStatus struct {
+	StatusLine
+
+	What    string
+	Char    string
+	Current int
+	Total   int
+}
+
+// PinentryLaunchedStatus reports that gpg-agent started a pinentry, which is
+// usually waiting for the user now.
+type PinentryLaunchedStatus struct {
+	StatusLine
+	PinentryLaunched
+}
+
+// PaddingStatus reports the padding gpg-agent removed from the plaintext of
+// a PKDECRYPT operation.
+type PaddingStatus struct {
+	StatusLine
+
+	Padding int
+}
+
+// InquireMaxLenStatus announces the maximum length of the data accepted by
+// the next inquiry.
+type InquireMaxLenStatus struct {
+	StatusLine
+
+	MaxLen int
+}
+
+// CacheNonceStatus passes the nonce under which gpg-agent cached the
+// passphrase used by the current command.
+type CacheNonceStatus struct {
+	StatusLine
+
+	Nonce string
+}
+
+// KeyCreatedAtStatus reports the creation time of a newly generated key.
+type KeyCreatedAtStatus struct {
+	StatusLine
+
+	Created time.Time
+}
+
+// parseStatus parses a status line, without its leading "S ", into the most
+// specific Status available.
+func parseStatus(line string) Status {
+	raw := StatusLine{Keyword: line}
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		raw = StatusLine{Keyword: line[:i], Params: strings.TrimSpace(line[i+1:])}
+	}
+
+	parts := strings.Fields(raw.Params)
+	switch raw.Keyword {
+	case "PROGRESS":
+		if len(parts) != 4 {
+			break
+		}
+
+		current, err1 := strconv.Atoi(parts[2])
+		total, err2 := strconv.Atoi(parts[3])
+		if err1 != nil || err2 != nil {
+			break
+		}
+
+		return ProgressStatus{StatusLine: raw, What: parts[0], Char: parts[1], Current: current, Total: total}
+
+	case InquirePinentryLaunched:
+		info, err := Inquiry{Keyword: raw.Keyword, Params: raw.Params}.PinentryLaunched()
+		if err != nil {
+			break
+		}
+
+		return PinentryLaunchedStatus{StatusLine: raw, PinentryLaunched: info}
+
+	case "PADDING":
+		if len(parts) != 1 {
+			break
+		}
+
+		padding, err := strconv.Atoi(parts[0])
+		if err != nil {
+			break
+		}
+
+		return PaddingStatus{StatusLine: raw, Padding: padding}
+
+	case "INQUIRE_MAXLEN":
+		if len(parts) != 1 {
+			break
+		}
+
+		maxLen, err := strconv.Atoi(parts[0])
+		if err != nil {
+			break
+		}
+
+		return InquireMaxLenStatus{StatusLine: raw, MaxLen: maxLen}
+
+	case "CACHE_NONCE":
+		if len(parts) != 1 {
+			break
+		}
+
+		return CacheNonceStatus{StatusLine: raw, Nonce: parts[0]}
+
+	case "KEY-CREATED-AT":
+		if len(parts) != 1 {
+			break
+		}
+
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			break
+		}
+
+		return KeyCreatedAtStatus{StatusLine: raw, Created: time.Unix(ts, 0)}
+	}
+
+	return raw
+}
+
+// Subscribe registers f to receive every status line read from this
+// connection, until the returned function is called.
+func (conn *Conn) Subscribe(f StatusFunc) (unsubscribe func()) {
+	conn.statusMu.Lock()
+	defer conn.statusMu.Unlock()
+
+	if conn.subscribers == nil {
+		conn.subscribers = map[int]StatusFunc{}
+	}
+
+	id := conn.nextSubscriber
+	conn.nextSubscriber++
+	conn.subscribers[id] = f
+
+	return func() {
+		conn.statusMu.Lock()
+		defer conn.statusMu.Unlock()
+
+		delete(conn.subscribers, id)
+	}
+}
+
+// publish delivers status to all subscribers.
+func (conn *Conn) publish(status Status) {
+	conn.statusMu.RLock()
+	subscribers := make([]StatusFunc, 0, len(conn.subscribers))
+	for _, f := range conn.subscribers {
+		subscribers = append(subscribers, f)
+	}
+	conn.statusMu.RUnlock()
+
+	for _, f := range subscribers {
+		f(status)
+	}
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bufio"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Status
+	}{
+		{
+			"PROGRESS primegen X 2 100",
+			ProgressStatus{StatusLine{"PROGRESS", "primegen X 2 100"}, "primegen", "X", 2, 100},
+		},
+		{
+			"PADDING 0",
+			PaddingStatus{StatusLine{"PADDING", "0"}, 0},
+		},
+		{
+			"INQUIRE_MAXLEN 255",
+			InquireMaxLenStatus{StatusLine{"INQUIRE_MAXLEN", "255"}, 255},
+		},
+		{
+			"CACHE_NONCE 8E0AE3E4D3F9CCB4A2EF3D94",
+			CacheNonceStatus{StatusLine{"CACHE_NONCE", "8E0AE3E4D3F9CCB4A2EF3D94"}, "8E0AE3E4D3F9CCB4A2EF3D94"},
+		},
+		{
+			"KEY-CREATED-AT 1600000000",
+			KeyCreatedAtStatus{StatusLine{"KEY-CREATED-AT", "1600000000"}, time.Unix(1600000000, 0)},
+		},
+		{
+			"PINENTRY_LAUNCHED 1234 gtk2 1.1.0 - :0",
+			PinentryLaunchedStatus{StatusLine{"PINENTRY_LAUNCHED", "1234 gtk2 1.1.0 - :0"}, PinentryLaunched{PID: 1234, Flavor: "gtk2", Version: "1.1.0", Display: ":0"}},
+		},
+		{
+			"PROGRESS garbage",
+			StatusLine{"PROGRESS", "garbage"},
+		},
+		{
+			"KEYINFO FF47135C1C28599504C27AC6AE1117B6E02079BD D - - - P - - -",
+			StatusLine{"KEYINFO", "FF47135C1C28599504C27AC6AE1117B6E02079BD D - - - P - - -"},
+		},
+	}
+
+	for _, test := range tests {
+		if status := parseStatus(test.line); status != test.expected {
+			t.Errorf("parseStatus(%q): expected %#v, but got %#v", test.line, test.expected, status)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	scripted := dialScripted(t, func(r *bufio.Reader, w io.Writer) {
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+
+			_, _ = io.WriteString(w, "S PROGRESS primegen X 1 2\nS PROGRESS primegen X 2 2\nOK\n")
+		}
+	})
+	defer scripted.Close()
+
+	var progress []ProgressStatus
+	unsubscribe := scripted.Subscribe(func(status Status) {
+		if p, ok := status.(ProgressStatus); ok {
+			progress = append(progress, p)
+		}
+	})
+
+	if err := scripted.Raw(nil, "GENKEY"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(progress) != 2 || progress[1].Current != 2 || progress[1].Total != 2 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	unsubscribe()
+	if err := scripted.Raw(nil, "GENKEY"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(progress) != 2 {
+		t.Errorf("expected no more progress after unsubscribing, but got %+v", progress)
+	}
+}
@@ -2,15 +2,63 @@ package agent
 
 import "strings"
 
-var (
-	decoder = strings.NewReplacer("%25", "%", "%0D", "\r", "%0A", "\n")
-	encoder = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
-)
+const hexDigits = "0123456789ABCDEF"
+
+// unescape undoes the percent-escaping of Assuan data. Any byte may be
+// escaped; malformed escapes are left as they are.
+func unescape(source []byte) []byte {
+	decoded := make([]byte, 0, len(source))
+	for i := 0; i < len(source); i++ {
+		if source[i] == '%' && i+2 < len(source) {
+			hi, ok1 := unhex(source[i+1])
+			lo, ok2 := unhex(source[i+2])
+			if ok1 && ok2 {
+				decoded = append(decoded, hi<<4|lo)
+				i += 2
+				continue
+			}
+		}
+
+		decoded = append(decoded, source[i])
+	}
+
+	return decoded
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+
+	return 0, false
+}
 
 func decode(source string) string {
-	return decoder.Replace(source)
+	return string(unescape([]byte(source)))
 }
 
-func encode(source string) string {
-	return encoder.Replace(source)
+// plusEscape escapes s the way gpg-agent expects the argument of SETKEYDESC:
+// blanks become plus signs, while plus signs, percent signs, quotes and
+// control characters are percent escaped.
+func plusEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ':
+			b.WriteByte('+')
+		case c == '+' || c == '%' || c == '"' || c < 0x20:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
 }
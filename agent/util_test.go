@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		escaped  string
+		expected []byte
+	}{
+		{"plain", []byte("plain")},
+		{"%25%0D%0A", []byte("%\r\n")},
+		{"%00%ff%FE", []byte{0x00, 0xff, 0xfe}},
+		{"100%", []byte("100%")},
+		{"%zz%4", []byte("%zz%4")},
+	}
+
+	for _, test := range tests {
+		if decoded := unescape([]byte(test.escaped)); !bytes.Equal(decoded, test.expected) {
+			t.Errorf("unescape(%q): expected %q, but got %q", test.escaped, test.expected, decoded)
+		}
+	}
+}
+
+func TestPlusEscape(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"Sign release v1.4.2 for repo X", "Sign+release+v1.4.2+for+repo+X"},
+		{"1+1=2, 100%", "1%2B1=2,+100%25"},
+		{"line\nbreak \"quoted\"", "line%0Abreak+%22quoted%22"},
+		{"Grüße", "Grüße"},
+	}
+
+	for _, test := range tests {
+		if escaped := plusEscape(test.s); escaped != test.expected {
+			t.Errorf("plusEscape(%q): expected %q, but got %q", test.s, test.expected, escaped)
+		}
+	}
+}
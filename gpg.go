@@ -2,28 +2,231 @@ package gpg
 
 import (
 	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
 	"strings"
+
+	"github.com/cognitive-i/gpg/internal/brainpool"
 )
 
-// Keygrip returns the keygrip of an RSA public key, or an empty string when
-// the public key is of a different type.
+// X25519PublicKey is a Curve25519 public key used for ECDH, the 32 byte
+// u-coordinate of RFC 7748.
+type X25519PublicKey []byte
+
+// ElGamalPublicKey is an ElGamal public key, as used by OpenPGP encryption
+// subkeys.
+type ElGamalPublicKey struct {
+	P, G, Y *big.Int
+}
+
+// BrainpoolP256r1 returns the brainpoolP256r1 curve of RFC 5639. Like the
+// other brainpool curves, its arithmetic is neither fast nor constant time:
+// it's good for holding public keys, computing their keygrips and verifying
+// signatures, but must not be used with secret scalars.
+func BrainpoolP256r1() elliptic.Curve {
+	return brainpool.P256r1()
+}
+
+// BrainpoolP384r1 returns the brainpoolP384r1 curve of RFC 5639, see
+// BrainpoolP256r1.
+func BrainpoolP384r1() elliptic.Curve {
+	return brainpool.P384r1()
+}
+
+// BrainpoolP512r1 returns the brainpoolP512r1 curve of RFC 5639, see
+// BrainpoolP256r1.
+func BrainpoolP512r1() elliptic.Curve {
+	return brainpool.P512r1()
+}
+
+// Keygrip returns the keygrip of a public key, or an empty string when it
+// can't be computed. See ComputeKeygrip for the supported key types.
 func Keygrip(publicKey crypto.PublicKey) string {
+	keygrip, err := ComputeKeygrip(publicKey)
+	if err != nil {
+		return ""
+	}
+
+	return keygrip
+}
+
+// ComputeKeygrip returns the keygrip of a public key, computed the way
+// libgcrypt does. The public key is either an *rsa.PublicKey, a
+// *dsa.PublicKey, an *ElGamalPublicKey, an *ecdsa.PublicKey on a NIST or
+// brainpool curve, an ed25519.PublicKey or an X25519PublicKey. RSA, DSA,
+// ElGamal and ECDSA keys may also be passed by value. Brainpool keys must use
+// the curves returned by BrainpoolP256r1, BrainpoolP384r1 or BrainpoolP512r1.
+func ComputeKeygrip(publicKey crypto.PublicKey) (string, error) {
 	sum := sha1.New()
 
 	switch key := publicKey.(type) {
 	case rsa.PublicKey:
-		sum.Write([]byte{0})
-		sum.Write(key.N.Bytes())
-		return strings.ToUpper(hex.EncodeToString(sum.Sum(nil)))
+		return ComputeKeygrip(&key)
 
 	case *rsa.PublicKey:
 		sum.Write([]byte{0})
 		sum.Write(key.N.Bytes())
-		return strings.ToUpper(hex.EncodeToString(sum.Sum(nil)))
+
+	case dsa.PublicKey:
+		return ComputeKeygrip(&key)
+
+	case *dsa.PublicKey:
+		writeParams(sum, "pqgy", key.P, key.Q, key.G, key.Y)
+
+	case ElGamalPublicKey:
+		return ComputeKeygrip(&key)
+
+	case *ElGamalPublicKey:
+		writeParams(sum, "pgy", key.P, key.G, key.Y)
+
+	case ecdsa.PublicKey:
+		return ComputeKeygrip(&key)
+
+	case *ecdsa.PublicKey:
+		c, err := weierstrassCurve(key.Curve)
+		if err != nil {
+			return "", err
+		}
+
+		c.write(sum, elliptic.Marshal(key.Curve, key.X, key.Y))
+
+	case ed25519.PublicKey:
+		if len(key) != ed25519.PublicKeySize {
+			return "", errors.New("github.com/cognitive-i/gpg: invalid ed25519 public key")
+		}
+
+		// Both keys are hashed in their compact form, without the 0x40 prefix
+		// gpg-agent uses.
+		ed25519Curve.write(sum, key)
+
+	case X25519PublicKey:
+		if len(key) != 32 {
+			return "", errors.New("github.com/cognitive-i/gpg: invalid x25519 public key")
+		}
+
+		curve25519.write(sum, key)
+
+	default:
+		return "", fmt.Errorf("github.com/cognitive-i/gpg: unsupported public key type %T", publicKey)
+	}
+
+	return strings.ToUpper(hex.EncodeToString(sum.Sum(nil))), nil
+}
+
+// writeParams hashes the named integer parameters of a DSA or ElGamal key.
+// Those are hashed as libgcrypt stores them, with a leading zero byte if
+// the high bit is set.
+func writeParams(h hash.Hash, names string, values ...*big.Int) {
+	for i, v := range values {
+		b := v.Bytes()
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+
+		writeParam(h, names[i], b)
+	}
+}
+
+func writeParam(h hash.Hash, name byte, value []byte) {
+	fmt.Fprintf(h, "(1:%c%d:", name, len(value))
+	h.Write(value)
+	h.Write([]byte(")"))
+}
+
+// eccCurve holds the domain parameters libgcrypt hashes into the keygrip of
+// an ECC key. The cofactor isn't part of the keygrip.
+type eccCurve struct {
+	p, a, b, n *big.Int
+	gx, gy     *big.Int
+}
+
+// write hashes the domain parameters and the public point q.
+func (c eccCurve) write(h hash.Hash, q []byte) {
+	size := (c.p.BitLen() + 7) / 8
+	g := append([]byte{4}, pad(c.gx.Bytes(), size)...)
+	g = append(g, pad(c.gy.Bytes(), size)...)
+
+	writeParam(h, 'p', c.p.Bytes())
+	writeParam(h, 'a', c.a.Bytes())
+	writeParam(h, 'b', c.b.Bytes())
+	writeParam(h, 'g', g)
+	writeParam(h, 'n', c.n.Bytes())
+	writeParam(h, 'q', q)
+}
+
+// weierstrassCurve returns the domain parameters of a NIST or brainpool
+// curve.
+func weierstrassCurve(curve elliptic.Curve) (eccCurve, error) {
+	params := curve.Params()
+
+	a, ok := brainpool.A(curve)
+	if !ok {
+		switch params.Name {
+		case "P-224", "P-256", "P-384", "P-521":
+			// The NIST curves have a = -3.
+			a = new(big.Int).Sub(params.P, big.NewInt(3))
+		default:
+			return eccCurve{}, fmt.Errorf("github.com/cognitive-i/gpg: unsupported curve %s", params.Name)
+		}
+	}
+
+	return eccCurve{
+		p:  params.P,
+		a:  a,
+		b:  params.B,
+		n:  params.N,
+		gx: params.Gx,
+		gy: params.Gy,
+	}, nil
+}
+
+// ed25519Curve and curve25519 are the twisted Edwards and Montgomery forms
+// of Curve25519, with the parameters as libgcrypt hashes them. libgcrypt
+// defines a and b of Ed25519 as negative numbers and hashes their absolute
+// values.
+var (
+	ed25519Curve = eccCurve{
+		p:  fromHex("7FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFED"),
+		a:  fromHex("01"),
+		b:  fromHex("2DFC9311D490018C7338BF8688861767FF8FF5B2BEBE27548A14B235ECA6874A"),
+		n:  fromHex("1000000000000000000000000000000014DEF9DEA2F79CD65812631A5CF5D3ED"),
+		gx: fromHex("216936D3CD6E53FEC0A4E231FDD6DC5C692CC7609525A7B2C9562D608F25D51A"),
+		gy: fromHex("6666666666666666666666666666666666666666666666666666666666666658"),
+	}
+
+	curve25519 = eccCurve{
+		p:  fromHex("7FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFED"),
+		a:  fromHex("01DB41"),
+		b:  fromHex("01"),
+		n:  fromHex("1000000000000000000000000000000014DEF9DEA2F79CD65812631A5CF5D3ED"),
+		gx: fromHex("09"),
+		gy: fromHex("20AE19A1B8A086B4E01EDD2C7748D14C923D4D7E6D7C61B229E9C5A27ECED3D9"),
+	}
+)
+
+// pad left-pads b with zeros to size bytes.
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func fromHex(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("gpg: invalid constant " + s)
 	}
 
-	return ""
+	return v
 }
@@ -1,7 +1,13 @@
 package gpg
 
 import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"encoding/hex"
 	"math/big"
 	"testing"
 )
@@ -39,3 +45,173 @@ func TestKeygrip(t *testing.T) {
 		t.Errorf("expected keygrip %q, but got %q", expectedKeyGrip, keygrip)
 	}
 }
+
+// The keygrip vectors below were computed by gpg-agent.
+var keygripTests = []struct {
+	name    string
+	key     crypto.PublicKey
+	keygrip string
+}{
+	{
+		name:    "rsa",
+		key:     &pubKey,
+		keygrip: "C729393956A1361239C64EFB3DAC4D3735A003ED",
+	},
+	{
+		name: "ed25519",
+		key: ed25519.PublicKey(fromHexString(
+			"7DC50CE9D04EAE6FB12321385594D959640E48DDDDE897144BE47AD535C33E4C")),
+		keygrip: "770A5FFBBF7F3C7BDEA46A5424381EBE721CBFF4",
+	},
+	{
+		name: "cv25519",
+		key: X25519PublicKey(fromHexString(
+			"258C6132D036F45AB0EE104E49A66A8CDBB631C3991CB949E354BBC1C9148E74")),
+		keygrip: "59C0B121A7D6C71D2E18C509918B33BE76B65FEF",
+	},
+	{
+		name: "P-256",
+		key: ecdsaPublicKey(elliptic.P256(),
+			"04A5EA8428EA8F803D3CCEC1CF8B078498200B4CB9F9451923733156915281F6"+
+				"36217D8FD6C4B0F817489E091929631D325A7FB0FB9C3F487C91336273FC4CEA"+
+				"33"),
+		keygrip: "4F95208EB84095F5B0CC1FD2BEA57F0729606AFD",
+	},
+	{
+		name: "P-384",
+		key: ecdsaPublicKey(elliptic.P384(),
+			"042158B088D56D46327A7552E84044160BD07153EB703AF26766414230A03791"+
+				"69FDC51AD2A4107A4F6473730EE7D27B6E545784C4B1DAE73C03AC6D7019E1E9"+
+				"C7F4A5221417A06FE89B18C7EE822E2FECD2C42EE26AECBDBC2E3D21CE3CF842"+
+				"B3"),
+		keygrip: "B361024958DEB33E3929DBEFE03E3F4DD85DF5A4",
+	},
+	{
+		name: "P-521",
+		key: ecdsaPublicKey(elliptic.P521(),
+			"040093F449B63379DCD827E0D718B8AB77570FF032E4B319DA83B1BC4393625A"+
+				"3B9F7F3A93E9582D0058247C79B4DEEA16BAE3CBECE9547C5EEF80AF89576E06"+
+				"1666CA00DFB73FC8D901443EB7E6611D58D27A00B8DCE98C4CE85B1606194248"+
+				"BB457F30ECE7FA7A3BF33215E000DE8918424CE68586DCA9A0387640FECA180F"+
+				"0EA41ECF21"),
+		keygrip: "6E603D511277792F128EBDAA8FB167E8E7CCEE63",
+	},
+	{
+		name: "brainpoolP256r1",
+		key: ecdsaPublicKey(BrainpoolP256r1(),
+			"045D011E82667661E5383A1577A9B800F6B227D6777C286356EB4B87C06ABE09"+
+				"25300B451181DD2E078AA78772FDD23E2B3DDCD78A213122B3B048A4BF9ADEBC"+
+				"9F"),
+		keygrip: "56CEA3E995AF7F5976F5065958D934932461C045",
+	},
+	{
+		name: "brainpoolP384r1",
+		key: ecdsaPublicKey(BrainpoolP384r1(),
+			"04408517C5978F38136E0997BA1BA2F6D782925A7808BB0ADC67ED09B84C7A23"+
+				"E1A44D612DFA5CDB2B96A51C3797E26E0C11284D92D23301100901856B7CA1CE"+
+				"2D7BC9BD712F01D7493B1E6D13E634C727C7F5B7BDD6FA89B2CB85A7AFFD745C"+
+				"31"),
+		keygrip: "7EBC2DFE95D3B4055BF62ACF6327C9B4F96350F4",
+	},
+	{
+		name: "brainpoolP512r1",
+		key: ecdsaPublicKey(BrainpoolP512r1(),
+			"0409C76C6BDE0C9C52240E1ECEB12BB30F2A8A4DC0BFC7487C1C3E4EB7711F8E"+
+				"9A298A13E8B9CF5FAC565E4356D81AC656C01E219DBF404DA70B58AB3E6F6B23"+
+				"CA0ACB9F6552147A276DE75C1B9191D6F4F0448375AE06E883442F63E219BB23"+
+				"F6485557F55997ACA6A4C6358849D2F461F3B0660DAC9A48182BECC3F1043FAE"+
+				"DA"),
+		keygrip: "1DB226324B7D8412F68B3628F57715B50847FD13",
+	},
+	{
+		name: "dsa",
+		key: &dsa.PublicKey{
+			Parameters: dsa.Parameters{
+				P: fromHex(
+					"B3F91BF51B61DBF6121D329FA63FFF164DCDC74C6C8ABDAEDDBB7B5E1CE54CBE" +
+						"515B6674FC6496C6A7CB50C17267B1B18F121216B74DCF17923C20906ED17168" +
+						"BA1F33D4C662250AAD05D8E99C75EB6EDE3913517867ADDABFE1A78EFF1F6894" +
+						"F25843E9932030CA9CE973DBCC7298448634DB5EF1BD17AFAA5ABB13BEA5A237"),
+				Q: fromHex("AC8AC86A3B9B17B66803C13126D5F4E0E8894133"),
+				G: fromHex(
+					"4DD985EC505984392CB02D9118AF122F04388FC3FC1F4586A184AF6118AF3163" +
+						"3BFC5D099DB2195E4CC63301BCE5CF51FC6128A4715B330C5DCADCAE7533FE2E" +
+						"390D30B15685CD9308A3D95AE93ED4D5E756D73AC9C62462F50520840CB992F4" +
+						"9B497D1571252D62205EFB16400160C5F14BB58BB54C3882A33DBE06AA2D2E8F"),
+			},
+			Y: fromHex(
+				"290DF46043E3F403B67AA943DECDF53D28F105570AFCBA7F1056E65673C6DAF1" +
+					"A641D184BB4062479F7450D623117E3D497785755029EEEF3F8BEC9C226EA27C" +
+					"E4B1073EC32D6C190F1C06A1C5EE075CB18B372FAEA2DDC4875713036A650C93" +
+					"320BC5DB561D8C136C90F9A82B245485F5CB9B7482594DDEFD341CA7C6FF22F8"),
+		},
+		keygrip: "68860AF6948B9E2632459A22D1841BAA91611A61",
+	},
+	{
+		name: "elg",
+		key: &ElGamalPublicKey{
+			P: fromHex(
+				"CE37A083EBCB68C3A4141656477A0E3EE5FF068E154E23A250229E46E00D7175" +
+					"A339B451441E59E836BA6A318E29AD17BADC019F4D388DAC9961B8C5266E0833" +
+					"904CC23A656FCB41413AFFF4F71D076444914C20E22484930008F4EDD1795585" +
+					"16F67FD38D41CACC13F125AF7525D5C43551E069BC6518F6AF1006BED0ADA897"),
+			G: fromHex("11"),
+			Y: fromHex(
+				"1C93CC1BAB835D6F5E3B864759AB13A195366237DD6967867F7A667A813F85F1" +
+					"0B3A72B2D475E30675D46D56014D92602F8D526219AA2F310A868D1F2DDFF773" +
+					"B27BA55F8BFAAA034C374A8714BEB599D52F58CCA2C855439465B9620F217034" +
+					"C55FCBAD4BBFCB7203DF112BE8EA9C8206C7AA568BD7F72060EFE6852CC5FCFC"),
+		},
+		keygrip: "EEB20B1CF2EECAFB48DCE13C64890F15AEF9F40A",
+	},
+}
+
+func TestComputeKeygrip(t *testing.T) {
+	for _, test := range keygripTests {
+		keygrip, err := ComputeKeygrip(test.key)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if keygrip != test.keygrip {
+			t.Errorf("%s: expected keygrip %q, but got %q", test.name, test.keygrip, keygrip)
+		}
+	}
+}
+
+func TestComputeKeygripUnsupported(t *testing.T) {
+	for _, key := range []crypto.PublicKey{
+		nil,
+		"not a key",
+		ed25519.PublicKey{1, 2, 3},
+		X25519PublicKey{1, 2, 3},
+		&ecdsa.PublicKey{Curve: &elliptic.CurveParams{Name: "secp256k1"}},
+	} {
+		if _, err := ComputeKeygrip(key); err == nil {
+			t.Errorf("%T: expected an error", key)
+		}
+
+		if keygrip := Keygrip(key); keygrip != "" {
+			t.Errorf("%T: expected an empty keygrip, but got %q", key, keygrip)
+		}
+	}
+}
+
+func fromHexString(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func ecdsaPublicKey(curve elliptic.Curve, q string) *ecdsa.PublicKey {
+	x, y := elliptic.Unmarshal(curve, fromHexString(q))
+	if x == nil {
+		panic("invalid point " + q)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+}
@@ -0,0 +1,208 @@
+// Package brainpool implements the brainpool r1 curves of RFC 5639 as
+// elliptic.Curve, well enough to hold public keys and verify signatures.
+//
+// The arithmetic is neither fast nor constant time, so it must not be used
+// with secret scalars. Signing is left to gpg-agent anyway.
+package brainpool
+
+import (
+	"crypto/elliptic"
+	"math/big"
+)
+
+// curve is a short Weierstrass curve y² = x³ + ax + b. Unlike the arithmetic
+// of elliptic.CurveParams, it does not assume a = -3.
+type curve struct {
+	params *elliptic.CurveParams
+	a      *big.Int
+}
+
+var (
+	p256r1 = newCurve("brainpoolP256r1", 256,
+		"A9FB57DBA1EEA9BC3E660A909D838D726E3BF623D52620282013481D1F6E5377",
+		"7D5A0975FC2C3057EEF67530417AFFE7FB8055C126DC5C6CE94A4B44F330B5D9",
+		"26DC5C6CE94A4B44F330B5D9BBD77CBF958416295CF7E1CE6BCCDC18FF8C07B6",
+		"8BD2AEB9CB7E57CB2C4B482FFC81B7AFB9DE27E1E3BD23C23A4453BD9ACE3262",
+		"547EF835C3DAC4FD97F8461A14611DC9C27745132DED8E545C1D54C72F046997",
+		"A9FB57DBA1EEA9BC3E660A909D838D718C397AA3B561A6F7901E0E82974856A7")
+
+	p384r1 = newCurve("brainpoolP384r1", 384,
+		"8CB91E82A3386D280F5D6F7E50E641DF152F7109ED5456B412B1DA197FB71123ACD3A729901D1A71874700133107EC53",
+		"7BC382C63D8C150C3C72080ACE05AFA0C2BEA28E4FB22787139165EFBA91F90F8AA5814A503AD4EB04A8C7DD22CE2826",
+		"04A8C7DD22CE28268B39B55416F0447C2FB77DE107DCD2A62E880EA53EEB62D57CB4390295DBC9943AB78696FA504C11",
+		"1D1C64F068CF45FFA2A63A81B7C13F6B8847A3E77EF14FE3DB7FCAFE0CBD10E8E826E03436D646AAEF87B2E247D4AF1E",
+		"8ABE1D7520F9C2A45CB1EB8E95CFD55262B70B29FEEC5864E19C054FF99129280E4646217791811142820341263C5315",
+		"8CB91E82A3386D280F5D6F7E50E641DF152F7109ED5456B31F166E6CAC0425A7CF3AB6AF6B7FC3103B883202E9046565")
+
+	p512r1 = newCurve("brainpoolP512r1", 512,
+		"AADD9DB8DBE9C48B3FD4E6AE33C9FC07CB308DB3B3C9D20ED6639CCA703308717D4D9B009BC66842AECDA12AE6A380E62881FF2F2D82C68528AA6056583A48F3",
+		"7830A3318B603B89E2327145AC234CC594CBDD8D3DF91610A83441CAEA9863BC2DED5D5AA8253AA10A2EF1C98B9AC8B57F1117A72BF2C7B9E7C1AC4D77FC94CA",
+		"3DF91610A83441CAEA9863BC2DED5D5AA8253AA10A2EF1C98B9AC8B57F1117A72BF2C7B9E7C1AC4D77FC94CADC083E67984050B75EBAE5DD2809BD638016F723",
+		"81AEE4BDD82ED9645A21322E9C4C6A9385ED9F70B5D916C1B43B62EEF4D0098EFF3B1F78E2D0D48D50D1687B93B97D5F7C6D5047406A5E688B352209BCB9F822",
+		"7DDE385D566332ECC0EABFA9CF7822FDF209F70024A57B1AA000C55B881F8111B2DCDE494A5F485E5BCA4BD88A2763AED1CA2B2FA8F0540678CD1E0F3AD80892",
+		"AADD9DB8DBE9C48B3FD4E6AE33C9FC07CB308DB3B3C9D20ED6639CCA70330870553E5C414CA92619418661197FAC10471DB1D381085DDADDB58796829CA90069")
+)
+
+// P256r1 returns the brainpoolP256r1 curve.
+func P256r1() elliptic.Curve {
+	return p256r1
+}
+
+// P384r1 returns the brainpoolP384r1 curve.
+func P384r1() elliptic.Curve {
+	return p384r1
+}
+
+// P512r1 returns the brainpoolP512r1 curve.
+func P512r1() elliptic.Curve {
+	return p512r1
+}
+
+// A returns the a coefficient of c, and false if c isn't a brainpool curve.
+func A(c elliptic.Curve) (*big.Int, bool) {
+	bc, ok := c.(*curve)
+	if !ok {
+		return nil, false
+	}
+
+	return new(big.Int).Set(bc.a), true
+}
+
+func newCurve(name string, bitSize int, p, a, b, gx, gy, n string) *curve {
+	return &curve{
+		params: &elliptic.CurveParams{
+			Name:    name,
+			BitSize: bitSize,
+			P:       fromHex(p),
+			N:       fromHex(n),
+			B:       fromHex(b),
+			Gx:      fromHex(gx),
+			Gy:      fromHex(gy),
+		},
+		a: fromHex(a),
+	}
+}
+
+func fromHex(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("brainpool: invalid constant " + s)
+	}
+
+	return v
+}
+
+// Params implements the elliptic.Curve interface.
+func (c *curve) Params() *elliptic.CurveParams {
+	return c.params
+}
+
+// IsOnCurve implements the elliptic.Curve interface.
+func (c *curve) IsOnCurve(x, y *big.Int) bool {
+	p := c.params.P
+	if x.Sign() < 0 || x.Cmp(p) >= 0 || y.Sign() < 0 || y.Cmp(p) >= 0 {
+		return false
+	}
+
+	// y² = x³ + ax + b
+	lhs := new(big.Int).Mul(y, y)
+	lhs.Mod(lhs, p)
+
+	rhs := new(big.Int).Mul(x, x)
+	rhs.Add(rhs, c.a)
+	rhs.Mul(rhs, x)
+	rhs.Add(rhs, c.params.B)
+	rhs.Mod(rhs, p)
+
+	return lhs.Cmp(rhs) == 0
+}
+
+// Add implements the elliptic.Curve interface. The point at infinity is
+// represented as (0, 0), as in the elliptic package.
+func (c *curve) Add(x1, y1, x2, y2 *big.Int) (x, y *big.Int) {
+	if isInfinity(x1, y1) {
+		return new(big.Int).Set(x2), new(big.Int).Set(y2)
+	}
+	if isInfinity(x2, y2) {
+		return new(big.Int).Set(x1), new(big.Int).Set(y1)
+	}
+
+	p := c.params.P
+	if x1.Cmp(x2) == 0 {
+		if y1.Cmp(y2) == 0 {
+			return c.Double(x1, y1)
+		}
+
+		return new(big.Int), new(big.Int)
+	}
+
+	// λ = (y2 - y1) / (x2 - x1)
+	num := new(big.Int).Sub(y2, y1)
+	den := new(big.Int).Sub(x2, x1)
+	den.Mod(den, p)
+	lambda := num.Mul(num, den.ModInverse(den, p))
+	lambda.Mod(lambda, p)
+
+	return c.finish(lambda, x1, y1, x2)
+}
+
+// Double implements the elliptic.Curve interface.
+func (c *curve) Double(x1, y1 *big.Int) (x, y *big.Int) {
+	if isInfinity(x1, y1) || y1.Sign() == 0 {
+		return new(big.Int), new(big.Int)
+	}
+
+	p := c.params.P
+
+	// λ = (3x² + a) / 2y
+	num := new(big.Int).Mul(x1, x1)
+	num.Mul(num, big.NewInt(3))
+	num.Add(num, c.a)
+	den := new(big.Int).Lsh(y1, 1)
+	den.Mod(den, p)
+	lambda := num.Mul(num, den.ModInverse(den, p))
+	lambda.Mod(lambda, p)
+
+	return c.finish(lambda, x1, y1, x1)
+}
+
+// finish computes x = λ² - x1 - x2 and y = λ(x1 - x) - y1.
+func (c *curve) finish(lambda, x1, y1, x2 *big.Int) (x, y *big.Int) {
+	p := c.params.P
+
+	x = new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, x1)
+	x.Sub(x, x2)
+	x.Mod(x, p)
+
+	y = new(big.Int).Sub(x1, x)
+	y.Mul(y, lambda)
+	y.Sub(y, y1)
+	y.Mod(y, p)
+
+	return x, y
+}
+
+// ScalarMult implements the elliptic.Curve interface.
+func (c *curve) ScalarMult(x1, y1 *big.Int, k []byte) (x, y *big.Int) {
+	x, y = new(big.Int), new(big.Int)
+	for _, b := range k {
+		for bit := 7; bit >= 0; bit-- {
+			x, y = c.Double(x, y)
+			if b>>uint(bit)&1 == 1 {
+				x, y = c.Add(x, y, x1, y1)
+			}
+		}
+	}
+
+	return x, y
+}
+
+// ScalarBaseMult implements the elliptic.Curve interface.
+func (c *curve) ScalarBaseMult(k []byte) (x, y *big.Int) {
+	return c.ScalarMult(c.params.Gx, c.params.Gy, k)
+}
+
+func isInfinity(x, y *big.Int) bool {
+	return x.Sign() == 0 && y.Sign() == 0
+}
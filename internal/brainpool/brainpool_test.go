@@ -0,0 +1,51 @@
+package brainpool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestCurves(t *testing.T) {
+	for _, c := range []elliptic.Curve{P256r1(), P384r1(), P512r1()} {
+		params := c.Params()
+		if !c.IsOnCurve(params.Gx, params.Gy) {
+			t.Errorf("%s: generator is not on the curve", params.Name)
+		}
+
+		if x, y := c.ScalarBaseMult(params.N.Bytes()); !isInfinity(x, y) {
+			t.Errorf("%s: generator doesn't have order N", params.Name)
+		}
+
+		x, y := c.ScalarBaseMult([]byte{5})
+		x2, y2 := c.Double(params.Gx, params.Gy)
+		x4, y4 := c.Add(x2, y2, x2, y2)
+		if x5, y5 := c.Add(x4, y4, params.Gx, params.Gy); x.Cmp(x5) != 0 || y.Cmp(y5) != 0 {
+			t.Errorf("%s: 5G doesn't equal 4G + G", params.Name)
+		}
+	}
+}
+
+func TestECDSA(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(P256r1(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+
+	digest := sha256.Sum256([]byte("Hello World"))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		t.Fatalf("Sign(): %s", err)
+	}
+
+	if !ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		t.Fatal("Verify(): invalid signature")
+	}
+
+	digest[0] ^= 1
+	if ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		t.Fatal("Verify(): accepted signature of a different digest")
+	}
+}